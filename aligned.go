@@ -0,0 +1,303 @@
+// +build linux
+
+package iouring
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// hugePageSize is the default huge page size on amd64 and arm64.
+	hugePageSize = 2 << 20
+)
+
+var (
+	errForeignBuffer     = errors.New("buffer was not allocated by the AlignedBuffers")
+	errBufferNotInUse    = errors.New("buffer was already returned")
+	errBuffersClosed     = errors.New("aligned buffers are closed")
+	errBuffersRegistered = errors.New("buffers are already registered")
+)
+
+// AlignedBuffersOption is an option for configuring AlignedBuffers.
+type AlignedBuffersOption func(*AlignedBuffers) error
+
+// WithAlignment is used to set the alignment of the start of each buffer, it
+// must be a power of two. The default is the page size, which satisfies the
+// alignment that O_DIRECT requires.
+func WithAlignment(align int) AlignedBuffersOption {
+	return func(b *AlignedBuffers) error {
+		if align < 1 || align&(align-1) != 0 {
+			return errors.New("alignment must be a power of two")
+		}
+		b.align = align
+		return nil
+	}
+}
+
+// WithHugePages is used to back the buffers with huge pages, huge pages must
+// be reserved with vm.nr_hugepages or creating the buffers fails.
+func WithHugePages() AlignedBuffersOption {
+	return func(b *AlignedBuffers) error {
+		b.huge = true
+		return nil
+	}
+}
+
+// AlignedBuffers is a pool of equally sized buffers that are allocated from
+// a single anonymous mmap. The memory is not managed by the Go runtime so the
+// buffers never move, which makes them safe to use with O_DIRECT and to
+// register as fixed buffers with a ring. Buffers must not be used after the
+// AlignedBuffers are closed.
+type AlignedBuffers struct {
+	mem []byte
+	// base is the address of the first buffer.
+	base   uintptr
+	off    int
+	size   int
+	stride int
+	count  int
+	align  int
+	huge   bool
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	free   []int
+	inUse  []bool
+	closed bool
+	// r is the ring the buffers are registered with.
+	r *Ring
+}
+
+// NewAlignedBuffers is used to create count buffers of size bytes.
+func NewAlignedBuffers(count, size int, opts ...AlignedBuffersOption) (*AlignedBuffers, error) {
+	if count < 1 || size < 1 {
+		return nil, errors.New("count and size must be greater than zero")
+	}
+	pageSize := os.Getpagesize()
+	b := &AlignedBuffers{
+		size:  size,
+		count: count,
+		align: pageSize,
+	}
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+	b.stride = alignUp(size, b.align)
+
+	// Mappings start on a page boundary, larger alignments need padding.
+	length := b.stride * count
+	mapAlign := pageSize
+	flags := unix.MAP_PRIVATE | unix.MAP_ANONYMOUS | unix.MAP_POPULATE
+	if b.huge {
+		mapAlign = hugePageSize
+		flags |= unix.MAP_HUGETLB
+	}
+	if b.align > mapAlign {
+		length += b.align - mapAlign
+	}
+	length = alignUp(length, mapAlign)
+	mem, err := unix.Mmap(-1, 0, length, unix.PROT_READ|unix.PROT_WRITE, flags)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	start := uintptr(unsafe.Pointer(&mem[0]))
+	b.mem = mem
+	b.off = int(uintptr(alignUp(int(start), b.align)) - start)
+	b.base = start + uintptr(b.off)
+
+	b.cond = sync.NewCond(&b.mu)
+	b.inUse = make([]bool, count)
+	b.free = make([]int, count)
+	for i := range b.free {
+		// Hand out the buffers in order.
+		b.free[i] = count - 1 - i
+	}
+	return b, nil
+}
+
+// alignUp rounds n up to a multiple of align, which is a power of two.
+func alignUp(n, align int) int {
+	return (n + align - 1) &^ (align - 1)
+}
+
+// Len returns the number of buffers.
+func (b *AlignedBuffers) Len() int {
+	return b.count
+}
+
+// Size returns the size of each buffer.
+func (b *AlignedBuffers) Size() int {
+	return b.size
+}
+
+// Buffer returns the buffer with the index, buffers returned by Buffer are not
+// tracked by the pool.
+func (b *AlignedBuffers) Buffer(i int) []byte {
+	o := b.off + i*b.stride
+	return b.mem[o : o+b.size : o+b.size]
+}
+
+// Get returns a buffer from the pool, it blocks until a buffer is returned if
+// all of them are in use. Nil is returned once the buffers are closed.
+func (b *AlignedBuffers) Get() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.free) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return nil
+	}
+	return b.get()
+}
+
+// TryGet returns a buffer from the pool without blocking, false is returned
+// if no buffer is available.
+func (b *AlignedBuffers) TryGet() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.free) == 0 || b.closed {
+		return nil, false
+	}
+	return b.get(), true
+}
+
+// get takes the next free buffer, the lock must be held.
+func (b *AlignedBuffers) get() []byte {
+	i := b.free[len(b.free)-1]
+	b.free = b.free[:len(b.free)-1]
+	b.inUse[i] = true
+	return b.Buffer(i)
+}
+
+// Put returns a buffer from Get or TryGet to the pool, the buffer may have
+// been resliced as long as it still starts at the same address.
+func (b *AlignedBuffers) Put(buf []byte) error {
+	i, ok := b.Index(buf)
+	if !ok || uintptr(unsafe.Pointer(&buf[0])) != b.base+uintptr(i*b.stride) {
+		return errForeignBuffer
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBuffersClosed
+	}
+	if !b.inUse[i] {
+		return errBufferNotInUse
+	}
+	b.inUse[i] = false
+	b.free = append(b.free, i)
+	b.cond.Signal()
+	return nil
+}
+
+// Index returns the index of the buffer that buf is within, which is the
+// index of the buffer when it is registered as a fixed buffer.
+func (b *AlignedBuffers) Index(buf []byte) (int, bool) {
+	if len(buf) == 0 {
+		return 0, false
+	}
+	p := uintptr(unsafe.Pointer(&buf[0]))
+	if p < b.base || p >= b.base+uintptr(b.stride*b.count) {
+		return 0, false
+	}
+	i := int(p-b.base) / b.stride
+	if int(p-b.base)+len(buf) > i*b.stride+b.size {
+		return 0, false
+	}
+	return i, true
+}
+
+// Register is used to register the buffers as fixed buffers of the ring,
+// reads and writes of a File on the ring then use fixed requests for the
+// buffers. A ring only has one set of registered buffers.
+func (b *AlignedBuffers) Register(r *Ring) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBuffersClosed
+	}
+	if b.r != nil || r.fixedBuffers() != nil {
+		return errBuffersRegistered
+	}
+	vecs := make([]syscall.Iovec, b.count)
+	for i := range vecs {
+		vecs[i].Base = &b.Buffer(i)[0]
+		vecs[i].SetLen(b.size)
+	}
+	if err := RegisterBuffers(r.fd, vecs); err != nil {
+		return os.NewSyscallError("io_uring_register", err)
+	}
+	b.r = r
+	r.fixed.Store(b)
+	return nil
+}
+
+// Unregister is used to unregister the buffers from the ring they were
+// registered with.
+func (b *AlignedBuffers) Unregister() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.unregister()
+}
+
+// unregister is used to unregister the buffers, the lock must be held.
+func (b *AlignedBuffers) unregister() error {
+	r := b.r
+	if r == nil {
+		return nil
+	}
+	b.r = nil
+	r.fixed.Store((*AlignedBuffers)(nil))
+	// The buffers are released by the kernel when the ring is closed.
+	select {
+	case <-r.stop:
+		return nil
+	default:
+	}
+	if err := UnregisterBuffers(r.fd); err != nil {
+		return os.NewSyscallError("io_uring_register", err)
+	}
+	return nil
+}
+
+// Close unregisters the buffers and unmaps their memory, Get calls that are
+// blocked return nil.
+func (b *AlignedBuffers) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBuffersClosed
+	}
+	b.closed = true
+	b.cond.Broadcast()
+	err := b.unregister()
+	if merr := unix.Munmap(b.mem); merr != nil && err == nil {
+		err = os.NewSyscallError("munmap", merr)
+	}
+	return err
+}
+
+// fixedBuffers returns the buffers that are registered with the ring.
+func (r *Ring) fixedBuffers() *AlignedBuffers {
+	b, _ := r.fixed.Load().(*AlignedBuffers)
+	return b
+}
+
+// fixedIndex returns the index of the registered buffer that b is within.
+func (r *Ring) fixedIndex(b []byte) (uint16, bool) {
+	bufs := r.fixedBuffers()
+	if bufs == nil {
+		return 0, false
+	}
+	i, ok := bufs.Index(b)
+	return uint16(i), ok
+}
@@ -0,0 +1,221 @@
+// +build linux
+
+package iouring
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlignedBuffers(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		align int
+	}{
+		{name: "page", size: 4096},
+		{name: "small", size: 100, align: 512},
+		{name: "unaligned size", size: 5000},
+		{name: "large alignment", size: 4096, align: 1 << 20},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var opts []AlignedBuffersOption
+			align := os.Getpagesize()
+			if test.align != 0 {
+				opts = append(opts, WithAlignment(test.align))
+				align = test.align
+			}
+			bufs, err := NewAlignedBuffers(4, test.size, opts...)
+			require.NoError(t, err)
+			defer bufs.Close()
+			require.Equal(t, 4, bufs.Len())
+			require.Equal(t, test.size, bufs.Size())
+
+			for i := 0; i < bufs.Len(); i++ {
+				b := bufs.Buffer(i)
+				require.Len(t, b, test.size)
+				require.Equal(t, test.size, cap(b))
+				require.Zero(t, uintptr(unsafe.Pointer(&b[0]))%uintptr(align))
+				// The buffers don't overlap.
+				for j := range b {
+					b[j] = byte(i)
+				}
+				idx, ok := bufs.Index(b[1:])
+				require.True(t, ok)
+				require.Equal(t, i, idx)
+			}
+			for i := 0; i < bufs.Len(); i++ {
+				require.Equal(t, bytes.Repeat([]byte{byte(i)}, test.size), bufs.Buffer(i))
+			}
+		})
+	}
+
+	_, err := NewAlignedBuffers(1, 4096, WithAlignment(3000))
+	require.Error(t, err)
+	_, err = NewAlignedBuffers(0, 4096)
+	require.Error(t, err)
+}
+
+func TestAlignedBuffersPool(t *testing.T) {
+	bufs, err := NewAlignedBuffers(2, 4096)
+	require.NoError(t, err)
+
+	b1 := bufs.Get()
+	b2, ok := bufs.TryGet()
+	require.True(t, ok)
+	require.True(t, &b1[0] != &b2[0])
+	_, ok = bufs.TryGet()
+	require.False(t, ok)
+
+	require.Equal(t, errForeignBuffer, bufs.Put(make([]byte, 4096)))
+	require.Equal(t, errForeignBuffer, bufs.Put(b1[1:]))
+	_, ok = bufs.Index(make([]byte, 10))
+	require.False(t, ok)
+
+	// Get blocks until a buffer is returned.
+	got := make(chan []byte)
+	go func() {
+		got <- bufs.Get()
+	}()
+	select {
+	case <-got:
+		t.Fatal("Get returned while all buffers are in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, bufs.Put(b1[:10]))
+	require.True(t, &b1[0] == &(<-got)[0])
+	require.NoError(t, bufs.Put(b2))
+	require.Equal(t, errBufferNotInUse, bufs.Put(b2))
+
+	// Close wakes up blocked calls to Get.
+	b3 := bufs.Get()
+	require.NotNil(t, b3)
+	go func() {
+		got <- bufs.Get()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, bufs.Close())
+	require.Nil(t, <-got)
+	require.Error(t, bufs.Close())
+}
+
+func TestAlignedBuffersRegister(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	bufs, err := NewAlignedBuffers(8, 64<<10)
+	require.NoError(t, err)
+	defer bufs.Close()
+	require.NoError(t, bufs.Register(r))
+	require.Equal(t, errBuffersRegistered, bufs.Register(r))
+	other, err := NewAlignedBuffers(1, 4096)
+	require.NoError(t, err)
+	defer other.Close()
+	require.Equal(t, errBuffersRegistered, other.Register(r))
+
+	dir, err := ioutil.TempDir("", "aligned")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f, err := r.OpenFile(filepath.Join(dir, "data"), os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Reads and writes of registered buffers use fixed requests, parts of
+	// a buffer can be used too.
+	w := bufs.Get()
+	rand.Read(w)
+	n, err := f.WriteAt(w, 4096)
+	require.NoError(t, err)
+	require.Equal(t, len(w), n)
+	_, err = f.Write(w[100:200])
+	require.NoError(t, err)
+
+	got := bufs.Get()
+	n, err = f.ReadAt(got, 4096)
+	require.NoError(t, err)
+	require.Equal(t, len(got), n)
+	require.Equal(t, w, got)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	n, err = f.Read(got[:100])
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, w[100:200], got[:100])
+
+	// Unregistered buffers are still usable.
+	require.NoError(t, bufs.Unregister())
+	require.NoError(t, bufs.Unregister())
+	n, err = f.ReadAt(got, 4096)
+	require.NoError(t, err)
+	require.Equal(t, w, got[:n])
+	require.NoError(t, other.Register(r))
+}
+
+func TestAlignedBuffersDirectIO(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	bufs, err := NewAlignedBuffers(2, 16<<10)
+	require.NoError(t, err)
+	defer bufs.Close()
+	require.NoError(t, bufs.Register(r))
+
+	// O_DIRECT is not supported by every file system, such as tmpfs.
+	dir, err := ioutil.TempDir(".", "aligned")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "direct")
+	f, err := r.OpenFile(name, os.O_RDWR|os.O_CREATE|syscall.O_DIRECT, 0644)
+	if err != nil && err.(*os.PathError).Err == syscall.EINVAL {
+		t.Skip("file system does not support O_DIRECT")
+	}
+	require.NoError(t, err)
+	defer f.Close()
+
+	w := bufs.Get()
+	rand.Read(w)
+	n, err := f.Write(w)
+	if err != nil && err.(*os.PathError).Err == syscall.EINVAL {
+		t.Skip("file system does not support O_DIRECT with this alignment")
+	}
+	require.NoError(t, err)
+	require.Equal(t, len(w), n)
+
+	got := bufs.Get()
+	n, err = f.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(got), n)
+	require.Equal(t, w, got)
+
+	// A short direct read at the end of the file returns io.EOF.
+	require.NoError(t, f.Truncate(int64(len(w)-100)))
+	n, err = f.ReadAt(got, 0)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, len(w)-100, n)
+	require.Equal(t, w[:n], got[:n])
+}
+
+func TestAlignedBuffersHugePages(t *testing.T) {
+	bufs, err := NewAlignedBuffers(2, 4096, WithHugePages())
+	if err != nil {
+		t.Skipf("huge pages are not available: %v", err)
+	}
+	defer bufs.Close()
+	b := bufs.Get()
+	require.Zero(t, uintptr(unsafe.Pointer(&b[0]))%hugePageSize)
+	b[0] = 1
+}
@@ -0,0 +1,192 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// BroadcastOption is an option for a Broadcast.
+type BroadcastOption func(*broadcast) error
+
+type broadcast struct {
+	flags    int
+	retry    bool
+	deadline time.Time
+}
+
+// WithBroadcastFlags sets the MSG_* flags used for each send, MSG_NOSIGNAL
+// is always set.
+func WithBroadcastFlags(flags int) BroadcastOption {
+	return func(b *broadcast) error {
+		b.flags = flags
+		return nil
+	}
+}
+
+// WithBroadcastRetry is used to send the rest of the message after a short
+// send, or a send that failed with EAGAIN, once the socket is writable.
+// Broadcast then blocks until the message is sent to every socket or the
+// send fails, unless WithBroadcastDeadline is also used.
+func WithBroadcastRetry() BroadcastOption {
+	return func(b *broadcast) error {
+		b.retry = true
+		return nil
+	}
+}
+
+// WithBroadcastDeadline sets a deadline for the retries of
+// WithBroadcastRetry, the wait for each socket to become writable is linked
+// to a timeout. Sockets that didn't take the whole message by then fail with
+// a net.Error whose Timeout method returns true.
+func WithBroadcastDeadline(t time.Time) BroadcastOption {
+	return func(b *broadcast) error {
+		b.deadline = t
+		return nil
+	}
+}
+
+// Broadcast sends msg to every socket in fds. The sends are submitted in
+// batches the size of the submit queue with a single enter of the ring for
+// each batch and msg is kept alive until every send has completed. The
+// returned errors are in the same order as fds, an error is nil if the
+// message was sent to the socket. The sends use MSG_DONTWAIT so that a slow
+// peer doesn't hold up the others, a socket whose buffer is full fails with
+// EAGAIN and short sends return io.ErrShortWrite unless WithBroadcastRetry is
+// used.
+func (r *Ring) Broadcast(fds []int, msg []byte, opts ...BroadcastOption) []error {
+	errs := make([]error, len(fds))
+	b := broadcast{}
+	for _, opt := range opts {
+		if err := opt(&b); err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
+	}
+	if len(msg) == 0 {
+		return errs
+	}
+
+	sent := make([]int, len(fds))
+	todo := make([]int, len(fds))
+	for i := range todo {
+		todo[i] = i
+	}
+	// Retries are linked to a poll so they don't spin on a full socket.
+	poll := false
+	for len(todo) > 0 {
+		var timeout time.Duration
+		if poll && !b.deadline.IsZero() {
+			timeout = time.Until(b.deadline)
+			if timeout <= 0 {
+				for _, i := range todo {
+					errs[i] = errTimeout
+				}
+				break
+			}
+		}
+		per := 1
+		if poll {
+			per++
+		}
+		if timeout > 0 {
+			per++
+		}
+		var next []int
+		size := int(r.p.SqEntries) / per
+		if size == 0 {
+			size = 1
+		}
+		for len(todo) > 0 {
+			n := size
+			if n > len(todo) {
+				n = len(todo)
+			}
+			batch := todo[:n]
+			todo = todo[n:]
+			next = append(next, r.broadcast(fds, msg, sent, errs, batch, b, poll, timeout)...)
+		}
+		todo = next
+		poll = true
+	}
+	runtime.KeepAlive(msg)
+	return errs
+}
+
+// broadcast sends the unsent part of msg to the fds in the batch and returns
+// the fds that need to be retried. If poll is set each send waits until its
+// socket is writable, for at most timeout if it is set.
+func (r *Ring) broadcast(
+	fds []int,
+	msg []byte,
+	sent []int,
+	errs []error,
+	batch []int,
+	b broadcast,
+	poll bool,
+	timeout time.Duration,
+) []int {
+	ts := syscall.NsecToTimespec(int64(timeout))
+	var preps []func(*SubmitEntry)
+	for _, i := range batch {
+		fd, p := fds[i], msg[sent[i]:]
+		if poll {
+			preps = append(preps, func(sqe *SubmitEntry) {
+				prepPollAdd(sqe, fd, POLLOUT)
+				sqe.Flags |= SqeIoLink
+			})
+		}
+		if timeout > 0 {
+			preps = append(preps, func(sqe *SubmitEntry) {
+				prepLinkTimeout(sqe, &ts)
+				sqe.Flags |= SqeIoLink
+			})
+		}
+		preps = append(preps, func(sqe *SubmitEntry) {
+			prepSend(sqe, fd, p, b.flags|syscall.MSG_NOSIGNAL|syscall.MSG_DONTWAIT)
+		})
+	}
+	results, err := r.batch(preps...)
+	runtime.KeepAlive(&ts)
+	if err != nil {
+		for _, i := range batch {
+			errs[i] = err
+		}
+		return nil
+	}
+
+	per := len(results) / len(batch)
+	var retry []int
+	for j, i := range batch {
+		rs := results[j*per : (j+1)*per]
+		res := rs[len(rs)-1]
+		if poll && rs[0] < 0 {
+			// A failed poll cancels the send.
+			res = rs[0]
+		}
+		switch {
+		case poll && timeout > 0 && rs[0] == -int32(syscall.ECANCELED):
+			errs[i] = errTimeout
+		case res == -int32(syscall.EAGAIN) && b.retry:
+			retry = append(retry, i)
+		case res < 0:
+			errs[i] = os.NewSyscallError("send", syscall.Errno(-res))
+		default:
+			sent[i] += int(res)
+			if sent[i] < len(msg) {
+				if b.retry {
+					retry = append(retry, i)
+				} else {
+					errs[i] = io.ErrShortWrite
+				}
+			}
+		}
+	}
+	return retry
+}
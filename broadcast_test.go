@@ -0,0 +1,156 @@
+// +build linux
+
+package iouring
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// broadcastPairs returns n connected socket pairs, the first fd of each pair
+// is used for sending.
+func broadcastPairs(t *testing.T, n int, nonblock bool) ([]int, []*os.File) {
+	fds := make([]int, n)
+	peers := make([]*os.File, n)
+	for i := range fds {
+		typ := syscall.SOCK_STREAM | syscall.SOCK_CLOEXEC
+		if nonblock {
+			typ |= syscall.SOCK_NONBLOCK
+		}
+		pair, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+		require.NoError(t, err)
+		fds[i] = pair[0]
+		peers[i] = os.NewFile(uintptr(pair[1]), "peer")
+	}
+	return fds, peers
+}
+
+func closeBroadcastPairs(fds []int, peers []*os.File) {
+	for i := range fds {
+		syscall.Close(fds[i])
+		peers[i].Close()
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	// The number of sockets is larger than the SQ to test batching.
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fds, peers := broadcastPairs(t, 50, false)
+	defer closeBroadcastPairs(fds, peers)
+
+	msg := []byte("data: hello\n\n")
+	errs := r.Broadcast(fds, msg)
+	require.Len(t, errs, len(fds))
+	for i, err := range errs {
+		require.NoError(t, err)
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(peers[i], buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, buf)
+	}
+}
+
+func TestBroadcastErrors(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fds, peers := broadcastPairs(t, 3, false)
+	defer closeBroadcastPairs(fds, peers)
+	require.NoError(t, peers[1].Close())
+
+	errs := r.Broadcast(append(fds, -1), []byte("hello"))
+	require.Len(t, errs, 4)
+	require.NoError(t, errs[0])
+	require.Error(t, errs[1])
+	require.Equal(t, syscall.EPIPE, errs[1].(*os.SyscallError).Err)
+	require.NoError(t, errs[2])
+	require.Equal(t, syscall.EBADF, errs[3].(*os.SyscallError).Err)
+}
+
+func TestBroadcastRetry(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fds, peers := broadcastPairs(t, 10, true)
+	defer closeBroadcastPairs(fds, peers)
+
+	// The message is larger than the socket buffers, so sends are short
+	// until the peers read.
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	var wg sync.WaitGroup
+	got := make([][]byte, len(peers))
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], _ = ioutil.ReadAll(io.LimitReader(peers[i], int64(len(msg))))
+		}(i)
+	}
+	errs := r.Broadcast(fds, msg, WithBroadcastRetry())
+	wg.Wait()
+	for i, err := range errs {
+		require.NoError(t, err)
+		require.Equal(t, msg, got[i])
+	}
+}
+
+// fillSocket writes to the blocking fd until its buffer is full.
+func fillSocket(t *testing.T, fd int) {
+	require.NoError(t, syscall.SetNonblock(fd, true))
+	b := make([]byte, 64<<10)
+	for {
+		if _, err := syscall.Write(fd, b); err == syscall.EAGAIN {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, syscall.SetNonblock(fd, false))
+}
+
+func TestBroadcastSlowPeer(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fds, peers := broadcastPairs(t, 3, false)
+	defer closeBroadcastPairs(fds, peers)
+	fillSocket(t, fds[1])
+
+	// A full socket doesn't block the sends to the others.
+	msg := []byte("hello")
+	errs := r.Broadcast(fds, msg)
+	require.NoError(t, errs[0])
+	require.Equal(t, syscall.EAGAIN, errs[1].(*os.SyscallError).Err)
+	require.NoError(t, errs[2])
+
+	// The retries wait until the deadline.
+	start := time.Now()
+	errs = r.Broadcast(fds, msg, WithBroadcastRetry(), WithBroadcastDeadline(start.Add(50*time.Millisecond)))
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+	require.NoError(t, errs[0])
+	require.Error(t, errs[1])
+	require.True(t, errs[1].(net.Error).Timeout())
+	require.NoError(t, errs[2])
+
+	for _, i := range []int{0, 2} {
+		buf := make([]byte, 2*len(msg))
+		_, err := io.ReadFull(peers[i], buf)
+		require.NoError(t, err)
+		require.Equal(t, append(msg, msg...), buf)
+	}
+}
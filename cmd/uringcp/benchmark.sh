@@ -0,0 +1,20 @@
+#!/bin/bash
+# Compares copying with io_uring to io.Copy, dropping the page cache requires
+# root.
+set -e
+
+go build -o uringcp .
+for fsize in 128 256 512 1024; do
+	dd if=/dev/urandom of=test bs=1M count="$fsize"
+	for args in "-stdlib" "-nosplice" ""; do
+		echo "benchmarking uringcp $args with a ${fsize}M file"
+		for i in {1..10}; do
+			echo 3 > /proc/sys/vm/drop_caches
+			time ./uringcp $args test test.copy
+			cmp --silent test test.copy || exit 1
+			rm -f test.copy
+		done
+		sync
+	done
+done
+rm -f test uringcp
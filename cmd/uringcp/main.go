@@ -0,0 +1,134 @@
+// uringcp copies a file using io_uring.
+//
+// Usage:
+//
+//	uringcp [flags] src dst
+//
+// Chunks of the file are copied concurrently with positional reads and
+// writes, see Ring.CopyFile. The -stdlib flag copies with io.Copy instead
+// which is useful for comparing the two, see benchmark.sh.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hodgesds/iouring-go"
+)
+
+var (
+	bufSize    int
+	queueDepth int
+	ringSize   uint
+	noSplice   bool
+	sparse     bool
+	sync       bool
+	progress   bool
+	stdlib     bool
+)
+
+func init() {
+	flag.IntVar(&bufSize, "buf", 1<<20, "size of each chunk that is copied")
+	flag.IntVar(&queueDepth, "qd", 8, "number of chunks copied concurrently")
+	flag.UintVar(&ringSize, "ring", 1024, "size of the ring")
+	flag.BoolVar(&noSplice, "nosplice", false, "copy through buffers instead of splicing")
+	flag.BoolVar(&sparse, "sparse", false, "preserve holes in sparse files")
+	flag.BoolVar(&sync, "sync", false, "fsync the destination once it is copied")
+	flag.BoolVar(&progress, "progress", false, "report progress on stderr")
+	flag.BoolVar(&stdlib, "stdlib", false, "copy with io.Copy instead of io_uring")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] src dst\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := os.Open(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst, err := os.OpenFile(args[1], os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	var n int64
+	if stdlib {
+		n, err = copyStdlib(dst, src)
+	} else {
+		n, err = copyRing(dst, src)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if progress {
+		elapsed := time.Since(start)
+		fmt.Fprintf(
+			os.Stderr,
+			"\ncopied %d bytes in %v (%.2f MB/s)\n",
+			n,
+			elapsed,
+			float64(n)/elapsed.Seconds()/1e6,
+		)
+	}
+}
+
+func copyRing(dst, src *os.File) (int64, error) {
+	r, err := iouring.New(ringSize, &iouring.Params{
+		Features: iouring.FeatNoDrop,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer r.Stop()
+
+	opts := iouring.CopyOptions{
+		BufferSize: bufSize,
+		QueueDepth: queueDepth,
+		NoSplice:   noSplice,
+		Sparse:     sparse,
+		Sync:       sync,
+	}
+	if progress {
+		var last time.Time
+		opts.Progress = func(copied, total int64) {
+			if now := time.Now(); now.Sub(last) > 100*time.Millisecond || copied == total {
+				last = now
+				fmt.Fprintf(os.Stderr, "\r%d/%d bytes (%d%%)", copied, total, copied*100/total)
+			}
+		}
+	}
+	return r.CopyFile(dst, src, opts)
+}
+
+func copyStdlib(dst, src *os.File) (int64, error) {
+	// Hide ReadFrom so that the copy goes through a buffer.
+	n, err := io.CopyBuffer(struct{ io.Writer }{dst}, src, make([]byte, bufSize))
+	if err != nil {
+		return n, err
+	}
+	if sync {
+		return n, dst.Sync()
+	}
+	return n, nil
+}
@@ -9,7 +9,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"syscall"
 )
 
@@ -46,12 +46,6 @@ func FastOpenAllowed() error {
 	return nil
 }
 
-type connInfo struct {
-	fd     int
-	id     uint64
-	sqeIds chan uint64
-}
-
 type addr struct {
 	net string
 	s   string
@@ -67,181 +61,224 @@ func (a *addr) String() string {
 	return a.s
 }
 
+var (
+	// errClosed is net.ErrClosed so that errors.Is works like it does for
+	// the net package.
+	errClosed = net.ErrClosed
+)
+
 type ringListener struct {
 	debug      bool
 	r          *Ring
 	f          *os.File
+	fd         int
 	a          *addr
 	stop       chan struct{}
 	errHandler func(error)
 	newConn    chan net.Conn
-	connGet    chan chan net.Conn
+	errs       chan error
+	sockopts   []int
+	accepts    int
+	wg         sync.WaitGroup
+
+	// unlinkStale is set to remove a stale Unix socket file before
+	// binding.
+	unlinkStale bool
+
+	// mu protects the ids of the accept requests that are in flight.
+	mu       sync.Mutex
+	closed   bool
+	inflight map[uint64]struct{}
+
+	// pd is used for polls done through SyscallConn.
+	pd ioDeadline
+
+	// conns limits the number of open connections, it is nil when there
+	// is no limit.
+	conns chan struct{}
 }
 
-// run is used to interact with the ring
-func (l *ringListener) run() {
-	id := l.r.ID()
-	fd := int(l.f.Fd())
-	cInfo := &connInfo{
-		fd: fd,
-		id: id,
-	}
-	sqe, commit := l.r.SubmitEntry()
-	sqe.Opcode = PollAdd
-	sqe.Fd = int32(fd)
-	sqe.UFlags = int32(POLLIN)
-	sqe.UserData = id
-	commit()
+// acquire is used to reserve a connection before accepting it, it blocks
+// while the connection limit is reached and returns false once the listener
+// is closed.
+func (l *ringListener) acquire() bool {
+	if l.conns == nil {
+		return true
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return true
+	case <-l.stop:
+		return false
+	}
+}
 
-	conns := map[uint64]*connInfo{id: cInfo}
+// release is used to release a connection that was reserved with acquire.
+func (l *ringListener) release() {
+	if l.conns != nil {
+		<-l.conns
+	}
+}
 
-	for {
-		select {
-		case <-l.stop:
-			return
-		default:
-			_, err := l.r.Enter(1024, 1, EnterGetEvents, nil)
-			if err != nil {
-				if l.errHandler != nil {
-					l.errHandler(err)
-				}
-				continue
-			}
-			l.walkCq(conns)
-		}
+// prepareAccept is used to prepare an accept SQE unless the listener has been
+// closed, it returns the id of the request and the request to wait on.
+func (l *ringListener) prepareAccept(
+	rsa *syscall.RawSockaddrAny, socklen *uint32) (uint64, *completionRequest, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, nil, false, nil
+	}
+	sqe, ready := l.r.SubmitEntry()
+	if sqe == nil {
+		return 0, nil, true, errRingUnavailable
 	}
+	prepAccept(sqe, l.fd, rsa, socklen, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+	id := l.r.ID()
+	sqe.UserData = id
+	req := l.r.wait(id)
+	ready()
+	l.inflight[id] = struct{}{}
+	return id, req, true, nil
 }
 
-func (l *ringListener) walkCq(conns map[uint64]*connInfo) {
-	head := atomic.LoadUint32(l.r.cq.Head)
-	tail := atomic.LoadUint32(l.r.cq.Tail)
-	mask := atomic.LoadUint32(l.r.cq.Mask)
-	if head&mask == tail&mask {
-		return
-	}
-
-	seenIdx := head & mask
-	seenEnd := false
-	if l.debug {
-		sqHead := *l.r.sq.Head
-		sqTail := *l.r.sq.Tail
-		sqMask := *l.r.sq.Mask
-		cqHead := *l.r.cq.Head
-		cqTail := *l.r.cq.Tail
-		cqMask := *l.r.cq.Mask
-		fmt.Printf("sq head: %v tail: %v\nsq entries: %+v\n", sqHead&sqMask, sqTail&sqMask, l.r.sq.Entries[:9])
-		fmt.Printf("cq head: %v tail: %v\ncq entries: %+v\n", cqHead&cqMask, cqTail&cqMask, l.r.cq.Entries[:9])
-	}
-	for i := seenIdx; i <= tail&mask; i++ {
-		cqe := l.r.cq.Entries[i]
-		if (cqe.Flags&CqSeenFlag == CqSeenFlag || cqe.IsZero()) && !seenEnd {
-			seenIdx = i
-		} else {
-			seenEnd = true
+// run keeps an accept request in flight on the ring until the listener is
+// closed, multiple accepts are in flight when run is called concurrently.
+func (l *ringListener) run() {
+	defer l.wg.Done()
+	for {
+		var (
+			rsa     syscall.RawSockaddrAny
+			socklen = uint32(syscall.SizeofSockaddrAny)
+		)
+		if !l.acquire() {
+			return
 		}
-		cInfo, ok := conns[cqe.UserData]
+		id, req, ok, err := l.prepareAccept(&rsa, &socklen)
 		if !ok {
-			continue
+			l.release()
+			return
 		}
-		l.r.cq.Entries[i].Flags |= CqSeenFlag
-		head = atomic.LoadUint32(l.r.cq.Head)
-		if seenIdx > head {
-			atomic.CompareAndSwapUint32(l.r.cq.Head, head, seenIdx)
+		if err != nil {
+			l.release()
+			if !l.onError(err) {
+				return
+			}
+			continue
 		}
-		l.onListen(conns, cInfo)
-		return
-	}
-
-	// Handle wrapping.
-	seenIdx = uint32(0)
-	seenEnd = false
-	tail = atomic.LoadUint32(l.r.cq.Tail)
-	mask = atomic.LoadUint32(l.r.cq.Mask)
-	for i := uint32(0); i <= tail&mask; i++ {
-		cqe := l.r.cq.Entries[i]
-		if (cqe.Flags&CqSeenFlag == CqSeenFlag || cqe.IsZero()) && !seenEnd {
-			seenIdx = i
-		} else {
-			seenEnd = true
+		if err := l.r.submit(); err != nil {
+			l.r.fail(id, err)
 		}
-		cInfo, ok := conns[cqe.UserData]
-		if !ok {
+		<-req.done
+		res, _ := l.r.release(req)
+		l.mu.Lock()
+		delete(l.inflight, id)
+		l.mu.Unlock()
+
+		if res < 0 {
+			l.release()
+			err := os.NewSyscallError("accept4", syscall.Errno(-res))
+			if !l.onError(err) {
+				return
+			}
 			continue
 		}
-		l.r.cq.Entries[i].Flags |= CqSeenFlag
-		head = atomic.LoadUint32(l.r.cq.Head)
-		if seenIdx > head {
-			atomic.CompareAndSwapUint32(l.r.cq.Head, head, seenIdx)
+		rc := &ringConn{
+			fd:      int(res),
+			r:       l.r,
+			laddr:   l.a,
+			raddr:   &addr{net: l.a.net},
+			release: l.release,
+		}
+		if sa, err := anyToSockaddr(&rsa, socklen); err == nil {
+			rc.raddr = sockaddrToAddr(l.a.net, sa)
+		}
+		select {
+		case l.newConn <- rc:
+		case <-l.stop:
+			rc.Close()
+			return
 		}
-		l.onListen(conns, cInfo)
-		return
 	}
 }
 
-// onListen is called when processing a cqe for a listening socket.
-func (l *ringListener) onListen(conns map[uint64]*connInfo, cInfo *connInfo) {
-	var (
-		newConnInfo connInfo
-		offset      int64
-		rc          = ringConn{
-			stop: make(chan struct{}, 2),
-			poll: make(chan uint64, 64),
-			r:    l.r,
-		}
-	)
-	for {
-		// Wait for a new connection to arrive and add it to the ring.
-		newFd, sa, err := syscall.Accept4(cInfo.fd, syscall.SOCK_NONBLOCK)
-		if err != nil {
-			// TODO: Log this or something?
-			panic(err.Error())
-		}
-		rc.fd = newFd
-		rc.laddr = l.a
-		rc.raddr = &addr{net: l.a.net}
-		switch sockType := sa.(type) {
-		case *syscall.SockaddrInet4:
-			rc.raddr.s = fmt.Sprintf("%s:%d", sockType.Addr, sockType.Port)
-		case *syscall.SockaddrInet6:
-			rc.raddr.s = fmt.Sprintf("%s:%d", sockType.Addr, sockType.Port)
-		case *syscall.SockaddrUnix:
-			rc.raddr.s = sockType.Name
-		}
-		rc.offset = &offset
-		break
-	}
-
-	// Add the new connection back to the ring.
-	sqe, commit := l.r.SubmitEntry()
-	sqe.Opcode = PollAdd
-	sqe.Fd = int32(rc.fd)
-	sqe.UFlags = int32(POLLIN)
-	sqe.UserData = newConnInfo.id
-	commit()
-	ready := int32(1)
-	rc.pollReady = &ready
-	go rc.run()
-
-	// Add the old connection back as well.
-	sqe, commit = l.r.SubmitEntry()
-	sqe.Opcode = PollAdd
-	sqe.Fd = int32(cInfo.fd)
-	sqe.UFlags = int32(POLLIN)
-	sqe.UserData = uint64(cInfo.fd)
-	commit()
-
-	// Wait for the new connection to be accepted.
-	// TODO: If this is unbuffered it will block, alternatively it could be
-	// sent in a separate goroutine to ensure the main ring code isn't
-	// blocking.
-	l.newConn <- &rc
+// onError is used to hand an accept error to the caller of Accept, it returns
+// false if the listener has been closed.
+func (l *ringListener) onError(err error) bool {
+	select {
+	case <-l.stop:
+		return false
+	default:
+	}
+	if l.errHandler != nil {
+		l.errHandler(err)
+	}
+	select {
+	case l.errs <- &net.OpError{Op: "accept", Net: l.a.net, Addr: l.a, Err: err}:
+		return true
+	case <-l.stop:
+		return false
+	}
 }
 
-// Close implements the net.Listener interface.
+// Close implements the net.Listener interface, any accepts that are in flight
+// are canceled.
 func (l *ringListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return &net.OpError{Op: "close", Net: l.a.net, Addr: l.a, Err: errClosed}
+	}
+	l.closed = true
 	close(l.stop)
+	ids := make([]uint64, 0, len(l.inflight))
+	for id := range l.inflight {
+		ids = append(ids, id)
+	}
+	l.mu.Unlock()
+
+	for _, id := range ids {
+		l.r.cancel(id)
+	}
+	l.pd.close(l.r)
+	l.wg.Wait()
+	// Connections that were accepted but never returned by Accept are
+	// closed.
+drain:
+	for {
+		select {
+		case c := <-l.newConn:
+			c.Close()
+		default:
+			break drain
+		}
+	}
 	return l.f.Close()
+}
+
+// SyscallConn implements the syscall.Conn interface.
+func (l *ringListener) SyscallConn() (syscall.RawConn, error) {
+	return &rawConn{r: l.r, fd: l.fd, rd: &l.pd, wd: &l.pd}, nil
+}
 
+// File returns a copy of the underlying os.File, it is the caller's
+// responsibility to close it. Closing the file does not close the listener.
+func (l *ringListener) File() (*os.File, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	raw := rawConn{r: l.r, fd: l.fd, rd: &l.pd, wd: &l.pd}
+	cerr := raw.Control(func(fd uintptr) {
+		f, err = dupFile(int(fd), l.a.net+":"+l.a.String())
+	})
+	if cerr == nil {
+		cerr = err
+	}
+	if cerr != nil {
+		return nil, &net.OpError{Op: "file", Net: l.a.net, Addr: l.a, Err: cerr}
+	}
+	return f, nil
 }
 
 // Addr implements the net.Listener interface.
@@ -251,7 +288,19 @@ func (l *ringListener) Addr() net.Addr {
 
 // Accept implements the net.Listener interface.
 func (l *ringListener) Accept() (net.Conn, error) {
-	return <-l.newConn, nil
+	select {
+	case <-l.stop:
+		return nil, &net.OpError{Op: "accept", Net: l.a.net, Addr: l.a, Err: errClosed}
+	default:
+	}
+	select {
+	case c := <-l.newConn:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.stop:
+		return nil, &net.OpError{Op: "accept", Net: l.a.net, Addr: l.a, Err: errClosed}
+	}
 }
 
 // Returns the file descriptor of the connection.
@@ -259,141 +308,158 @@ func (l *ringListener) Fd() int {
 	if l.f == nil {
 		return -1
 	}
-	return int(l.f.Fd())
+	return l.fd
+}
+
+// Listen returns a net.Listener that is Ring based. Connections are accepted
+// using accept requests that are kept in flight on the ring. Known networks
+// are "tcp", "tcp4", "tcp6", "unix" and "unixpacket". The "tcp" network
+// listens on both IPv4 and IPv6 when the host is empty or unspecified. Unix
+// addresses that start with '@' are in the Linux abstract namespace.
+func (r *Ring) Listen(network, address string, opts ...ListenerOption) (net.Listener, error) {
+	l := &ringListener{
+		r:        r,
+		a:        &addr{net: network},
+		stop:     make(chan struct{}),
+		newConn:  make(chan net.Conn, 1024),
+		errs:     make(chan error),
+		accepts:  1,
+		inflight: map[uint64]struct{}{},
+	}
+	for _, opt := range opts {
+		if err := opt(l); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.listen(network, address); err != nil {
+		return nil, err
+	}
+	l.debug = r.debug
+	l.wg.Add(l.accepts)
+	for i := 0; i < l.accepts; i++ {
+		go l.run()
+	}
+
+	return l, nil
 }
 
 // SockoptListener returns a net.Listener that is Ring based.
 func (r *Ring) SockoptListener(network, address string, errHandler func(error), sockopts ...int) (net.Listener, error) {
-	var (
-		err      error
-		fd       int
-		sockAddr syscall.Sockaddr
+	return r.Listen(
+		network,
+		address,
+		WithListenerErrHandler(errHandler),
+		WithSockopts(sockopts...),
 	)
-	l := &ringListener{
-		r:          r,
-		a:          &addr{net: network},
-		stop:       make(chan struct{}),
-		newConn:    make(chan net.Conn, 1024),
-		connGet:    make(chan chan net.Conn),
-		errHandler: errHandler,
+}
+
+// listen is used to create the listening socket.
+func (l *ringListener) listen(network, address string) error {
+	family, sotype, sa, dualStack, err := listenSockaddr(network, address)
+	if err != nil {
+		return &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	l.a.s = sockaddrToAddr(network, sa).s
+	if sotype == syscall.SOCK_STREAM && family != syscall.AF_UNIX {
+		l.a.net = "tcp"
+	}
+	opError := func(err error) error {
+		return &net.OpError{Op: "listen", Net: network, Addr: l.a, Err: err}
 	}
 
-	switch network {
-	case "tcp", "tcp4":
-		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		netAddr, err := net.ResolveTCPAddr(network, address)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		l.a.net = netAddr.Network()
-		l.a.s = netAddr.String()
-
-		var ipAddr [4]byte
-		copy(ipAddr[:], netAddr.IP)
-		sockAddr = &syscall.SockaddrInet4{
-			Port: netAddr.Port,
-			Addr: ipAddr,
-		}
-	case "tcp6":
-		fd, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, 0)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		netAddr, err := net.ResolveTCPAddr(network, address)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		l.a.net = netAddr.Network()
-		l.a.s = netAddr.String()
-
-		ipAddr := [16]byte{}
-		copy(ipAddr[:], netAddr.IP)
-		sockAddr = &syscall.SockaddrInet6{
-			Port: netAddr.Port,
-			Addr: ipAddr,
-		}
-	case "unix":
-		fd, err = syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
-		sockAddr = &syscall.SockaddrUnix{
-			Name: address,
-		}
-	case "udp", "udp4":
-		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	fd, err := syscall.Socket(family, sotype|syscall.SOCK_CLOEXEC, 0)
+	if err == syscall.EAFNOSUPPORT && dualStack {
+		// IPv6 is not available, only listen on IPv4.
+		family, sa, err = ipSockaddr("tcp4", nil, sa.(*syscall.SockaddrInet6).Port, "")
 		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
+			return opError(err)
 		}
-		netAddr, err := net.ResolveUDPAddr(network, address)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		ipAddr := [4]byte{}
-		copy(ipAddr[:], netAddr.IP)
-		sockAddr = &syscall.SockaddrInet4{
-			Port: netAddr.Port,
-			Addr: ipAddr,
-		}
-	case "udp6":
-		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		netAddr, err := net.ResolveUDPAddr(network, address)
-		if err != nil {
-			return nil, fmt.Errorf("could not open socket")
-		}
-		l.a.net = netAddr.Network()
-		l.a.s = netAddr.String()
-
-		ipAddr := [16]byte{}
-		copy(ipAddr[:], netAddr.IP)
-		sockAddr = &syscall.SockaddrInet6{
-			Port: netAddr.Port,
-			Addr: ipAddr,
-		}
-	default:
-		return nil, fmt.Errorf("unknown network family: %s", network)
+		fd, err = syscall.Socket(family, sotype|syscall.SOCK_CLOEXEC, 0)
 	}
 	if err != nil {
-		syscall.Close(fd)
-		return nil, err
+		return opError(os.NewSyscallError("socket", err))
+	}
+	if family == syscall.AF_INET6 {
+		err = syscall.SetsockoptInt(
+			fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, boolint(!dualStack))
+		if err != nil {
+			syscall.Close(fd)
+			return opError(os.NewSyscallError("setsockopt", err))
+		}
 	}
 
-	for _, sockopt := range sockopts {
+	for _, sockopt := range l.sockopts {
 		if sockopt == SOReuseport {
 			err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, sockopt, 1)
 			if err != nil {
 				syscall.Close(fd)
-				return nil, err
+				return opError(os.NewSyscallError("setsockopt", err))
 			}
 		} else if sockopt == TCPFastopen {
 			if err := FastOpenAllowed(); err != nil {
-				return nil, err
+				syscall.Close(fd)
+				return err
 			}
 			err = syscall.SetsockoptInt(fd, syscall.SOL_TCP, sockopt, 1)
 			if err != nil {
 				syscall.Close(fd)
-				return nil, err
+				return opError(os.NewSyscallError("setsockopt", err))
 			}
 		}
 	}
 
-	if err := syscall.Bind(fd, sockAddr); err != nil {
+	if l.unlinkStale {
+		if err := unlinkStale(sotype, sa); err != nil {
+			syscall.Close(fd)
+			return opError(err)
+		}
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return opError(os.NewSyscallError("bind", err))
 	}
 
 	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return opError(os.NewSyscallError("listen", err))
 	}
 
-	f := os.NewFile(uintptr(fd), "l")
-	l.f = f
-	l.debug = r.debug
-	go l.run()
+	// Use the bound address so that ephemeral ports are reported.
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		if a := sockaddrToAddr(l.a.net, sa); a.s != "" {
+			l.a.s = a.s
+		}
+	}
 
-	return l, nil
+	l.fd = fd
+	l.f = os.NewFile(uintptr(fd), "l")
+
+	return nil
+}
+
+// unlinkStale removes the file of a Unix socket that nothing is listening
+// on, such as one left behind by a process that exited without closing its
+// listener. Abstract sockets have no file and are ignored.
+func unlinkStale(sotype int, sa syscall.Sockaddr) error {
+	usa, ok := sa.(*syscall.SockaddrUnix)
+	if !ok || usa.Name == "" || usa.Name[0] == '@' {
+		return nil
+	}
+	fi, err := os.Stat(usa.Name)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		// Bind reports the error if the file can't be used.
+		return nil
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, sotype|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	err = syscall.Connect(fd, sa)
+	syscall.Close(fd)
+	if err != syscall.ECONNREFUSED {
+		// The socket is in use or isn't stale.
+		return nil
+	}
+	return os.Remove(usa.Name)
 }
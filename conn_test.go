@@ -2,25 +2,33 @@ package iouring
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestSockoptListener(t *testing.T) {
-	t.Skip("skip")
 	r, err := New(8192, nil)
 	require.NoError(t, err)
 	require.NotNil(t, r)
+	defer r.Stop()
 
-	l, err := r.SockoptListener("tcp", ":9822", nil)
+	l, err := r.SockoptListener("tcp", "127.0.0.1:0", nil)
 	require.NoError(t, err)
 	require.NotNil(t, l)
+	defer l.Close()
 
 	go func() {
-		conn2, err := net.Dial("tcp", ":9822")
+		conn2, err := net.Dial("tcp", l.Addr().String())
 		require.NoError(t, err)
 		require.NotNil(t, conn2)
 		require.NoError(t, conn2.Close())
@@ -31,6 +39,116 @@ func TestSockoptListener(t *testing.T) {
 	require.NoError(t, conn.Close())
 }
 
+func TestListenerAccepts(t *testing.T) {
+	r, err := New(8192, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", "127.0.0.1:0", WithAccepts(4))
+	require.NoError(t, err)
+	require.NotNil(t, l)
+
+	const nConns = 32
+	go func() {
+		for i := 0; i < nConns; i++ {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			conn.Write([]byte{byte(i)})
+			conn.Close()
+		}
+	}()
+	for i := 0; i < nConns; i++ {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		require.Equal(t, l.Addr().String(), conn.LocalAddr().String())
+		require.NotEmpty(t, conn.RemoteAddr().String())
+		buf := make([]byte, 1)
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+	require.NoError(t, l.Close())
+
+	_, err = l.Accept()
+	require.Error(t, err)
+}
+
+func TestListenerCloseCancelsAccept(t *testing.T) {
+	r, err := New(8192, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", "127.0.0.1:0", WithAccepts(2))
+	require.NoError(t, err)
+
+	accepted := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	require.NoError(t, l.Close())
+	require.Error(t, <-accepted)
+	require.Error(t, l.Close())
+}
+
+func TestListenerAcceptError(t *testing.T) {
+	r, err := New(8192, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	handled := make(chan error, 8)
+	l, err := r.Listen(
+		"tcp",
+		"127.0.0.1:0",
+		WithListenerErrHandler(func(err error) { handled <- err }),
+	)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Leave no file descriptors for the accepted connection.
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fd)
+	free, err := syscall.Dup(0)
+	require.NoError(t, err)
+	require.NoError(t, syscall.Close(free))
+
+	var lim syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim))
+	low := lim
+	low.Cur = uint64(free)
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low))
+
+	sa, err := syscall.Getsockname(l.(*ringListener).fd)
+	require.NoError(t, err)
+	err = syscall.Connect(fd, sa)
+	if err == nil {
+		_, err = l.Accept()
+	}
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim))
+	require.Error(t, err)
+	opErr, ok := err.(*net.OpError)
+	require.True(t, ok)
+	require.True(t, opErr.Temporary())
+	require.Error(t, <-handled)
+
+	// The connection is still pending once descriptors are available.
+	for i := 0; i < 3; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			continue
+		}
+		require.NoError(t, conn.Close())
+		return
+	}
+	t.Fatal("connection was never accepted")
+}
+
 func TestFastOpenAllowed(t *testing.T) {
 	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fack")
 	require.NoError(t, err)
@@ -40,3 +158,268 @@ func TestFastOpenAllowed(t *testing.T) {
 		require.Error(t, FastOpenAllowed())
 	}
 }
+
+func TestListenerSyscallConn(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	raw, err := l.(syscall.Conn).SyscallConn()
+	require.NoError(t, err)
+	var (
+		v    int
+		gerr error
+	)
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		v, gerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	}))
+	require.NoError(t, gerr)
+	require.Equal(t, 1, v)
+
+	f, err := l.(interface{ File() (*os.File, error) }).File()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, l.Close())
+	require.Error(t, raw.Control(func(uintptr) {}))
+	_, err = l.(interface{ File() (*os.File, error) }).File()
+	require.Error(t, err)
+}
+
+func TestListenerClosePending(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rl := l.(*ringListener)
+
+	// Connections are accepted by the ring but never by Accept.
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	for i := 0; len(rl.newConn) < len(clients); i++ {
+		require.True(t, i < 500, "connections were not accepted")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NoError(t, l.Close())
+	for _, c := range clients {
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err := c.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+	}
+	_, err = l.Accept()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "use of closed network connection")
+	require.True(t, errors.Is(err, net.ErrClosed))
+}
+
+func TestListenerMaxConns(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	_, err = r.Listen("tcp", "127.0.0.1:0", WithMaxConns(0))
+	require.Error(t, err)
+
+	l, err := r.Listen("tcp", "127.0.0.1:0", WithMaxConns(2), WithAccepts(4))
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+	}
+	c1, err := l.Accept()
+	require.NoError(t, err)
+	c2, err := l.Accept()
+	require.NoError(t, err)
+	defer c2.Close()
+
+	// The third connection is not accepted until one of the others is
+	// closed.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted more than the max conns")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, c1.Close())
+	select {
+	case c := <-accepted:
+		require.NoError(t, c.Close())
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept did not resume")
+	}
+}
+
+// testListenDial accepts a connection from the standard library dialer and
+// echoes a message over it.
+func testListenDial(t *testing.T, l net.Listener, network, address string) {
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			done <- err
+			return
+		}
+		_, err = conn.Write(b)
+		done <- err
+	}()
+
+	conn, err := net.Dial(network, address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	require.NoError(t, <-done)
+}
+
+func supportsIPv6() bool {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+func TestListenNetworks(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	sock := func(name string) string {
+		return fmt.Sprintf("%s/%s_%d.sock", os.TempDir(), name, rand.Int())
+	}
+	tests := []struct {
+		name    string
+		network string
+		address string
+		prefix  string
+		ipv6    bool
+	}{
+		{name: "tcp", network: "tcp", address: "127.0.0.1:0", prefix: "127.0.0.1:"},
+		{name: "tcp4", network: "tcp4", address: "127.0.0.1:0", prefix: "127.0.0.1:"},
+		{name: "tcp6", network: "tcp6", address: "[::1]:0", prefix: "[::1]:", ipv6: true},
+		{name: "unix", network: "unix", address: sock("listen_unix")},
+		{name: "unixpacket", network: "unixpacket", address: sock("listen_unixpacket")},
+		{name: "abstract", network: "unix", address: fmt.Sprintf("@iouring_test_%d", rand.Int())},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if test.ipv6 && !supportsIPv6() {
+				t.Skip("IPv6 is not supported")
+			}
+			l, err := r.Listen(test.network, test.address)
+			require.NoError(t, err)
+			defer l.Close()
+			if test.prefix != "" {
+				require.Contains(t, l.Addr().String(), test.prefix)
+			} else {
+				require.Equal(t, test.address, l.Addr().String())
+				if test.address[0] != '@' {
+					defer os.Remove(test.address)
+				}
+			}
+			testListenDial(t, l, test.network, l.Addr().String())
+		})
+	}
+}
+
+func TestListenDualStack(t *testing.T) {
+	if !supportsIPv6() {
+		t.Skip("IPv6 is not supported")
+	}
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	testListenDial(t, l, "tcp4", net.JoinHostPort("127.0.0.1", port))
+	testListenDial(t, l, "tcp6", net.JoinHostPort("::1", port))
+
+	// tcp6 only listens on IPv6.
+	l6, err := r.Listen("tcp6", "[::]:0")
+	require.NoError(t, err)
+	defer l6.Close()
+	_, port, err = net.SplitHostPort(l6.Addr().String())
+	require.NoError(t, err)
+	_, err = net.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+	require.Error(t, err)
+}
+
+func TestListenUnlinkStale(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	sockFile := fmt.Sprintf("%s/listen_stale_%d.sock", os.TempDir(), rand.Int())
+	defer os.Remove(sockFile)
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockFile, Net: "unix"})
+	require.NoError(t, err)
+	ul.SetUnlinkOnClose(false)
+
+	// The socket file is in use.
+	_, err = r.Listen("unix", sockFile, WithUnlinkStale())
+	require.Error(t, err)
+	require.NoError(t, ul.Close())
+
+	_, err = r.Listen("unix", sockFile)
+	require.Error(t, err)
+	opErr, ok := err.(*net.OpError)
+	require.True(t, ok)
+	require.Equal(t, "listen", opErr.Op)
+
+	l, err := r.Listen("unix", sockFile, WithUnlinkStale())
+	require.NoError(t, err)
+	defer l.Close()
+	testListenDial(t, l, "unix", sockFile)
+}
+
+func TestListenErrors(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	_, err = r.Listen("tcp4", "[::1]:0")
+	require.Error(t, err)
+	_, err = r.Listen("udp", "127.0.0.1:0")
+	require.Error(t, err)
+	_, err = r.Listen("ip", "127.0.0.1")
+	require.Error(t, err)
+	_, ok := err.(*net.OpError)
+	require.True(t, ok)
+}
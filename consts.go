@@ -105,6 +105,10 @@ const (
 	Splice
 	ProvideBuffers
 	RemoveBuffers
+	Tee
+	Shutdown
+	RenameAt
+	UnlinkAt
 	OpSupported = (1 << 0)
 )
 const (
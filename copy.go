@@ -0,0 +1,419 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultCopyBufferSize is the default size of the chunks copied by
+	// CopyFile.
+	defaultCopyBufferSize = 1 << 20
+
+	// defaultCopyQueueDepth is the default number of chunks that CopyFile
+	// keeps in flight.
+	defaultCopyQueueDepth = 8
+)
+
+// CopyOptions is used to configure CopyFile, the zero value uses the
+// defaults.
+type CopyOptions struct {
+	// BufferSize is the size of each chunk that is read and written, the
+	// default is 1 MiB.
+	BufferSize int
+
+	// QueueDepth is the number of chunks that are copied concurrently, the
+	// default is 8. Each chunk keeps a read and a write in flight.
+	QueueDepth int
+
+	// NoSplice disables splicing the chunks through a pipe, chunks are then
+	// read into a buffer and written from it.
+	NoSplice bool
+
+	// Sparse is used to preserve the holes of src, they are found with
+	// SEEK_DATA and SEEK_HOLE and punched in dst instead of being copied.
+	Sparse bool
+
+	// Sync flushes dst to disk with fsync once it has been copied.
+	Sync bool
+
+	// Progress is called each time a chunk is copied with the number of
+	// bytes of src that have been copied and the size of src. It is not
+	// called concurrently.
+	Progress func(copied, total int64)
+}
+
+// copyExtent is a range of the source file, holes are punched in the
+// destination instead of being copied.
+type copyExtent struct {
+	off  int64
+	n    int64
+	hole bool
+}
+
+// fileCopy is the state of a CopyFile.
+type fileCopy struct {
+	r        *Ring
+	dst, src int
+	opts     CopyOptions
+	size     int64
+	noSplice int32
+
+	// mu protects the chunks that are left and the error.
+	mu      sync.Mutex
+	extents []copyExtent
+	err     error
+	copied  int64
+}
+
+// CopyFile copies the contents of src to dst, dst is truncated or extended to
+// the size of src. The copy is split in chunks that are copied concurrently
+// with positional reads and writes, so the file offsets are not used. Chunks
+// are spliced through a pipe when the files support it, otherwise they are
+// copied through a buffer. Files that are not regular files are copied with
+// io.Copy. It returns the number of bytes of src that were copied, when an
+// error is returned they may not be contiguous.
+func (r *Ring) CopyFile(dst, src *os.File, opts CopyOptions) (int64, error) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultCopyBufferSize
+	}
+	if opts.QueueDepth <= 0 {
+		opts.QueueDepth = defaultCopyQueueDepth
+	}
+	sfi, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	dfi, err := dst.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !sfi.Mode().IsRegular() || !dfi.Mode().IsRegular() {
+		return io.Copy(dst, src)
+	}
+
+	c := &fileCopy{
+		r:    r,
+		dst:  int(dst.Fd()),
+		src:  int(src.Fd()),
+		opts: opts,
+		size: sfi.Size(),
+	}
+	if opts.NoSplice {
+		c.noSplice = 1
+	}
+	c.extents, err = fileExtents(c.src, c.size, opts.Sparse)
+	if err != nil {
+		return 0, &os.PathError{Op: "copy", Path: src.Name(), Err: err}
+	}
+	if err := dst.Truncate(c.size); err != nil {
+		return 0, err
+	}
+	if err := c.punchHoles(); err != nil {
+		return c.copied, &os.PathError{Op: "copy", Path: dst.Name(), Err: err}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(opts.QueueDepth)
+	for i := 0; i < opts.QueueDepth; i++ {
+		go func() {
+			defer wg.Done()
+			if err := c.run(); err != nil {
+				c.fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+	runtime.KeepAlive(src)
+	if c.err != nil {
+		return c.copied, &os.PathError{Op: "copy", Path: dst.Name(), Err: c.err}
+	}
+	if opts.Sync {
+		if err := r.Fsync(c.dst, 0); err != nil {
+			return c.copied, os.NewSyscallError("fsync", err)
+		}
+	}
+	runtime.KeepAlive(dst)
+	return c.copied, nil
+}
+
+// fileExtents returns the extents of the file of the given size. When sparse
+// is set the holes are found with SEEK_DATA and SEEK_HOLE, the file offset is
+// restored afterwards.
+func fileExtents(fd int, size int64, sparse bool) ([]copyExtent, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	if !sparse {
+		return []copyExtent{{off: 0, n: size}}, nil
+	}
+	cur, err := unix.Seek(fd, 0, io.SeekCurrent)
+	if err != nil {
+		return nil, os.NewSyscallError("lseek", err)
+	}
+	defer unix.Seek(fd, cur, io.SeekStart)
+
+	var extents []copyExtent
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		switch {
+		case err == syscall.ENXIO:
+			// The rest of the file is a hole.
+			data = size
+		case err == syscall.EINVAL && off == 0:
+			// SEEK_DATA is not supported, so copy everything.
+			return []copyExtent{{off: 0, n: size}}, nil
+		case err != nil:
+			return nil, os.NewSyscallError("lseek", err)
+		}
+		if data > size {
+			data = size
+		}
+		if data > off {
+			extents = append(extents, copyExtent{off: off, n: data - off, hole: true})
+		}
+		if data == size {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, os.NewSyscallError("lseek", err)
+		}
+		if hole > size {
+			hole = size
+		}
+		extents = append(extents, copyExtent{off: data, n: hole - data})
+		off = hole
+	}
+	return extents, nil
+}
+
+// punchHoles punches the holes of the source in the destination. Holes
+// are copied instead when the destination doesn't support punching holes.
+func (c *fileCopy) punchHoles() error {
+	for i, e := range c.extents {
+		if !e.hole {
+			continue
+		}
+		err := c.r.Fallocate(
+			c.dst,
+			unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+			e.off,
+			e.n,
+		)
+		switch err {
+		case nil:
+			c.progress(e.n)
+		case syscall.EOPNOTSUPP, syscall.EINVAL:
+			c.extents[i].hole = false
+		default:
+			return os.NewSyscallError("fallocate", err)
+		}
+	}
+	return nil
+}
+
+// next returns the next chunk to copy, it returns false once there are no
+// chunks left or the copy failed.
+func (c *fileCopy) next() (int64, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.err == nil && len(c.extents) > 0 {
+		e := &c.extents[0]
+		if e.hole || e.n == 0 {
+			c.extents = c.extents[1:]
+			continue
+		}
+		off, n := e.off, e.n
+		if n > int64(c.opts.BufferSize) {
+			n = int64(c.opts.BufferSize)
+		}
+		e.off += n
+		e.n -= n
+		return off, n, true
+	}
+	return 0, 0, false
+}
+
+// progress records that n more bytes have been copied.
+func (c *fileCopy) progress(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copied += n
+	if c.opts.Progress != nil {
+		c.opts.Progress(c.copied, c.size)
+	}
+}
+
+// fail records the first error of the copy, the remaining chunks are not
+// copied.
+func (c *fileCopy) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// run copies chunks until there are none left, it keeps a single chunk in
+// flight.
+func (c *fileCopy) run() error {
+	var (
+		buf  []byte
+		pipe = [2]int{-1, -1}
+		size int
+	)
+	defer func() {
+		if pipe[0] >= 0 {
+			syscall.Close(pipe[0])
+			syscall.Close(pipe[1])
+		}
+	}()
+	for {
+		off, n, ok := c.next()
+		if !ok {
+			return nil
+		}
+		done := int64(0)
+		if atomic.LoadInt32(&c.noSplice) == 0 {
+			if pipe[0] < 0 {
+				var err error
+				if pipe, size, err = copyPipe(c.opts.BufferSize); err != nil {
+					return err
+				}
+			}
+			var (
+				soff, doff = off, off
+				spliced    bool
+				err        error
+			)
+			done, spliced, err = c.r.splicePipe(
+				spliceEnd{fd: c.dst, off: &doff},
+				spliceEnd{fd: c.src, off: &soff},
+				pipe,
+				size,
+				n,
+			)
+			if err != nil && spliced {
+				return err
+			}
+			if !spliced {
+				atomic.StoreInt32(&c.noSplice, 1)
+			} else if done < n {
+				// The source was truncated during the copy.
+				return io.ErrUnexpectedEOF
+			}
+		}
+		if done < n {
+			if buf == nil {
+				buf = make([]byte, c.opts.BufferSize)
+			}
+			if err := c.r.copyChunk(c.dst, c.src, buf[:n-done], off+done); err != nil {
+				return err
+			}
+		}
+		c.progress(n)
+	}
+}
+
+// copyPipe creates a pipe for splicing chunks of the given size, the pipe is
+// grown to the size when possible. It returns the pipe and the most that can
+// be spliced through it at a time.
+func copyPipe(size int) ([2]int, int, error) {
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC); err != nil {
+		return pipe, 0, os.NewSyscallError("pipe2", err)
+	}
+	n, err := unix.FcntlInt(uintptr(pipe[1]), unix.F_SETPIPE_SZ, size)
+	if err != nil {
+		// The pipe is larger than allowed, keep the default capacity.
+		n = maxSpliceSize
+	}
+	if n > size {
+		n = size
+	}
+	return pipe, n, nil
+}
+
+// prepReadWrite returns a function that prepares a positional read or write
+// of b.
+func prepReadWrite(op Opcode, fd int, b []byte, off int64) func(*SubmitEntry) {
+	return func(sqe *SubmitEntry) {
+		sqe.Opcode = op
+		sqe.Fd = int32(fd)
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
+		sqe.Len = uint32(len(b))
+		sqe.Offset = uint64(off)
+	}
+}
+
+// copyChunk copies len(b) bytes at off from src to dst through b. The read
+// is linked to the write, a short read cancels the write which is then
+// submitted again for the bytes that were read.
+func (r *Ring) copyChunk(dst, src int, b []byte, off int64) error {
+	for len(b) > 0 {
+		res, err := r.link(
+			nil,
+			true,
+			prepReadWrite(Read, src, b, off),
+			prepReadWrite(Write, dst, b, off),
+		)
+		if err != nil {
+			return err
+		}
+		read, written := res[0], res[1]
+		switch {
+		case read < 0 && copyRetry(read):
+			continue
+		case read < 0:
+			return os.NewSyscallError("pread", syscall.Errno(-read))
+		case read == 0:
+			// The source was truncated during the copy.
+			return io.ErrUnexpectedEOF
+		}
+		// The write is canceled when the read is short.
+		pending, woff := b[:read], off
+		switch {
+		case written > 0:
+			pending, woff = pending[written:], woff+int64(written)
+		case written < 0 && !copyRetry(written):
+			return os.NewSyscallError("pwrite", syscall.Errno(-written))
+		}
+		for len(pending) > 0 {
+			res, err := r.link(nil, true, prepReadWrite(Write, dst, pending, woff))
+			if err != nil {
+				return err
+			}
+			switch {
+			case res[0] > 0:
+				pending, woff = pending[res[0]:], woff+int64(res[0])
+			case res[0] == 0:
+				return io.ErrShortWrite
+			case !copyRetry(res[0]):
+				return os.NewSyscallError("pwrite", syscall.Errno(-res[0]))
+			}
+		}
+		b = b[read:]
+		off += int64(read)
+	}
+	return nil
+}
+
+// copyRetry returns if a read or write result means it can be tried again, a
+// canceled request is tried again as it was linked to a short read.
+func copyRetry(res int32) bool {
+	switch syscall.Errno(-res) {
+	case syscall.EAGAIN, syscall.ECANCELED, syscall.EINTR:
+		return true
+	}
+	return false
+}
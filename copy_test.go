@@ -0,0 +1,202 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	src, data := spliceFile(t, 3<<20+4321)
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	tests := []struct {
+		name string
+		opts CopyOptions
+	}{
+		{name: "default"},
+		{name: "small", opts: CopyOptions{BufferSize: 4096, QueueDepth: 32}},
+		{name: "nosplice", opts: CopyOptions{BufferSize: 100000, NoSplice: true}},
+		{name: "sync", opts: CopyOptions{Sync: true}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dst, err := ioutil.TempFile("", "copy")
+			require.NoError(t, err)
+			defer os.Remove(dst.Name())
+			defer dst.Close()
+
+			var last int64
+			test.opts.Progress = func(copied, total int64) {
+				require.True(t, copied > last)
+				require.Equal(t, int64(len(data)), total)
+				last = copied
+			}
+			n, err := r.CopyFile(dst, src, test.opts)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, int64(len(data)), last)
+
+			got, err := ioutil.ReadFile(dst.Name())
+			require.NoError(t, err)
+			require.Equal(t, data, got)
+
+			// The file offsets are not used.
+			off, err := src.Seek(0, io.SeekCurrent)
+			require.NoError(t, err)
+			require.Equal(t, int64(0), off)
+		})
+	}
+}
+
+func TestCopyFileTruncates(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	src, data := spliceFile(t, 1000)
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, _ := spliceFile(t, 5000)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	n, err := r.CopyFile(dst, src, CopyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	got, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestCopyFileSparse(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	const size = 16 << 20
+	src, err := ioutil.TempFile("", "copy")
+	require.NoError(t, err)
+	defer os.Remove(src.Name())
+	defer src.Close()
+	require.NoError(t, src.Truncate(size))
+	chunk := make([]byte, 64<<10)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+	for _, off := range []int64{1 << 20, 8 << 20, size - int64(len(chunk))} {
+		_, err := src.WriteAt(chunk, off)
+		require.NoError(t, err)
+	}
+
+	// The holes of the destination must be punched.
+	dst, _ := spliceFile(t, size)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	n, err := r.CopyFile(dst, src, CopyOptions{Sparse: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(size), n)
+
+	want, err := ioutil.ReadFile(src.Name())
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	var sst, dst2 syscall.Stat_t
+	require.NoError(t, syscall.Fstat(int(src.Fd()), &sst))
+	require.NoError(t, syscall.Fstat(int(dst.Fd()), &dst2))
+	if sst.Blocks*512 >= size {
+		t.Skip("file system does not support sparse files")
+	}
+	require.True(t, dst2.Blocks*512 < size/2, "dst is not sparse: %d blocks", dst2.Blocks)
+}
+
+func TestCopyFileEmpty(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	src, _ := spliceFile(t, 0)
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, _ := spliceFile(t, 100)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	n, err := r.CopyFile(dst, src, CopyOptions{Sparse: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+	fi, err := dst.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fi.Size())
+}
+
+func benchmarkCopy(b *testing.B, copy func(dst, src *os.File) error) {
+	const size = 64 << 20
+	data := make([]byte, size)
+	src, err := ioutil.TempFile("", "copy")
+	require.NoError(b, err)
+	defer os.Remove(src.Name())
+	defer src.Close()
+	_, err = src.Write(data)
+	require.NoError(b, err)
+	dst, err := ioutil.TempFile("", "copy")
+	require.NoError(b, err)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := src.Seek(0, io.SeekStart)
+		require.NoError(b, err)
+		require.NoError(b, dst.Truncate(0))
+		_, err = dst.Seek(0, io.SeekStart)
+		require.NoError(b, err)
+		require.NoError(b, copy(dst, src))
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	r, err := New(1024, nil)
+	require.NoError(b, err)
+	defer r.Stop()
+
+	benchmarkCopy(b, func(dst, src *os.File) error {
+		_, err := r.CopyFile(dst, src, CopyOptions{})
+		return err
+	})
+}
+
+func BenchmarkCopyFileNoSplice(b *testing.B) {
+	r, err := New(1024, nil)
+	require.NoError(b, err)
+	defer r.Stop()
+
+	benchmarkCopy(b, func(dst, src *os.File) error {
+		_, err := r.CopyFile(dst, src, CopyOptions{NoSplice: true})
+		return err
+	})
+}
+
+func BenchmarkIOCopy(b *testing.B) {
+	benchmarkCopy(b, func(dst, src *os.File) error {
+		// Hide ReadFrom so that io.Copy uses a buffer.
+		_, err := io.Copy(struct{ io.Writer }{dst}, src)
+		return err
+	})
+}
@@ -0,0 +1,256 @@
+// +build linux
+
+package iouring
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	errTimeout error = &timeoutError{}
+)
+
+// timeoutError is returned when an I/O deadline is reached.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// ioDeadline is the deadline for one direction of a connection. Requests
+// started with do are linked with a timeout so the kernel cancels them once
+// the deadline passes.
+type ioDeadline struct {
+	mu       sync.Mutex
+	t        time.Time
+	gen      uint64
+	closed   bool
+	inflight map[uint64]struct{}
+}
+
+// inflightIDs returns the ids of the requests that are in flight, it must be
+// called with the lock held.
+func (d *ioDeadline) inflightIDs() []uint64 {
+	ids := make([]uint64, 0, len(d.inflight))
+	for id := range d.inflight {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// close cancels any requests that are in flight and fails any later ones
+// with errClosed. It returns false if it was already closed.
+func (d *ioDeadline) close(r *Ring) bool {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return false
+	}
+	d.closed = true
+	ids := d.inflightIDs()
+	d.mu.Unlock()
+	for _, id := range ids {
+		r.cancel(id)
+	}
+	return true
+}
+
+// set changes the deadline, requests that are in flight are canceled so
+// that they are restarted with the new deadline.
+func (d *ioDeadline) set(r *Ring, t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	d.gen++
+	ids := d.inflightIDs()
+	d.mu.Unlock()
+	for _, id := range ids {
+		r.cancel(id)
+	}
+}
+
+// do submits the request that is prepared by prep and waits for it to
+// complete. It returns errTimeout if the deadline passes before the request
+// completes and errClosed once closed.
+func (d *ioDeadline) do(r *Ring, prep func(*SubmitEntry)) (int32, error) {
+	return d.doRequest(r, false, prep)
+}
+
+// doIgnoreDeadline is like do, only the request isn't linked to the timeout
+// of the deadline. Close still cancels it.
+func (d *ioDeadline) doIgnoreDeadline(r *Ring, prep func(*SubmitEntry)) (int32, error) {
+	return d.doRequest(r, true, prep)
+}
+
+// doRequest is do, the request is linked to the timeout of the deadline
+// unless ignoreDeadline is set.
+func (d *ioDeadline) doRequest(r *Ring, ignoreDeadline bool, prep func(*SubmitEntry)) (int32, error) {
+	for {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return 0, errClosed
+		}
+		t, gen := d.t, d.gen
+		var timeout time.Duration
+		if !ignoreDeadline && !t.IsZero() {
+			timeout = time.Until(t)
+			if timeout <= 0 {
+				d.mu.Unlock()
+				return 0, errTimeout
+			}
+		}
+		n := 1
+		if timeout > 0 {
+			n = 2
+		}
+		sqes, ready := r.submitEntries(n)
+		if sqes == nil {
+			d.mu.Unlock()
+			return 0, errRingUnavailable
+		}
+		sqe := sqes[0]
+		prep(sqe)
+		sqe.UserData = r.ID()
+		if timeout > 0 {
+			sqe.Flags |= SqeIoLink
+			r.linkTimeout(sqes[1], timeout)
+		}
+		id := sqe.UserData
+		req := r.wait(id)
+		ready()
+		if err := r.submit(); err != nil {
+			r.fail(id, err)
+		}
+		if d.inflight == nil {
+			d.inflight = make(map[uint64]struct{})
+		}
+		d.inflight[id] = struct{}{}
+		d.mu.Unlock()
+
+		<-req.done
+		res, _ := r.release(req)
+
+		d.mu.Lock()
+		delete(d.inflight, id)
+		changed, closed := d.gen != gen, d.closed
+		d.mu.Unlock()
+		if res != -int32(syscall.ECANCELED) && res != -int32(syscall.EINTR) {
+			return res, nil
+		}
+		if closed {
+			return 0, errClosed
+		}
+		if changed {
+			// The deadline was changed while the request was in
+			// flight, try again with the new deadline.
+			continue
+		}
+		if timeout > 0 {
+			return 0, errTimeout
+		}
+		return res, nil
+	}
+}
+
+// chain is like do for a chain of linked requests, it returns the results of
+// the requests. The timeout is linked to the first request only, so the
+// requests after it must not block.
+func (d *ioDeadline) chain(r *Ring, preps ...func(*SubmitEntry)) ([]int32, error) {
+	for {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return nil, errClosed
+		}
+		t, gen := d.t, d.gen
+		var timeout time.Duration
+		if !t.IsZero() {
+			timeout = time.Until(t)
+			if timeout <= 0 {
+				d.mu.Unlock()
+				return nil, errTimeout
+			}
+		}
+		n := len(preps)
+		if timeout > 0 {
+			n++
+		}
+		sqes, ready := r.submitEntries(n)
+		if sqes == nil {
+			d.mu.Unlock()
+			return nil, errRingUnavailable
+		}
+		ids := make([]uint64, len(preps))
+		reqs := make([]*completionRequest, len(preps))
+		j := 0
+		for i, prep := range preps {
+			sqe := sqes[j]
+			j++
+			prep(sqe)
+			ids[i] = r.ID()
+			sqe.UserData = ids[i]
+			reqs[i] = r.wait(ids[i])
+			if i == 0 && timeout > 0 {
+				sqe.Flags |= SqeIoLink
+				r.linkTimeout(sqes[j], timeout)
+				sqe = sqes[j]
+				j++
+			}
+			if j < n {
+				sqe.Flags |= SqeIoLink
+			}
+		}
+		ready()
+		if err := r.submit(); err != nil {
+			for _, id := range ids {
+				r.fail(id, err)
+			}
+		}
+		if d.inflight == nil {
+			d.inflight = make(map[uint64]struct{})
+		}
+		for _, id := range ids {
+			d.inflight[id] = struct{}{}
+		}
+		d.mu.Unlock()
+
+		res := make([]int32, len(reqs))
+		for i, req := range reqs {
+			<-req.done
+			res[i], _ = r.release(req)
+		}
+
+		d.mu.Lock()
+		for _, id := range ids {
+			delete(d.inflight, id)
+		}
+		changed, closed := d.gen != gen, d.closed
+		d.mu.Unlock()
+		if res[0] != -int32(syscall.ECANCELED) && res[0] != -int32(syscall.EINTR) {
+			return res, nil
+		}
+		if closed {
+			return nil, errClosed
+		}
+		if changed {
+			// Nothing in the chain ran, try again with the new
+			// deadline.
+			continue
+		}
+		if timeout > 0 {
+			return nil, errTimeout
+		}
+		return res, nil
+	}
+}
+
+// linkTimeout prepares sqe as a timeout for the request that it is linked
+// to.
+func (r *Ring) linkTimeout(sqe *SubmitEntry, timeout time.Duration) {
+	ts := syscall.NsecToTimespec(int64(timeout))
+	prepLinkTimeout(sqe, &ts)
+	sqe.UserData = r.ID()
+	r.pin(sqe.UserData, &ts)
+}
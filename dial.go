@@ -0,0 +1,53 @@
+// +build linux
+
+package iouring
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Dial connects to the address on the named network using the ring and
+// returns a ring backed net.Conn. Known networks are "tcp", "tcp4", "tcp6"
+// and "unix".
+func (r *Ring) Dial(network, address string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial, only the connect is canceled if the context is
+// done before the connection is established.
+func (r *Ring) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	family, sa, err := resolveSockaddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	raddr := sockaddrToAddr(network, sa)
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+
+	fd, err := syscall.Socket(
+		family,
+		syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC,
+		0,
+	)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	if err := r.ConnectContext(ctx, fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+
+	c := &ringConn{
+		fd:    fd,
+		r:     r,
+		laddr: &addr{net: network},
+		raddr: raddr,
+	}
+	if lsa, err := syscall.Getsockname(fd); err == nil {
+		c.laddr = sockaddrToAddr(network, lsa)
+	}
+	return c, nil
+}
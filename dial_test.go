@@ -0,0 +1,145 @@
+// +build linux
+
+package iouring
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testDialEcho(t *testing.T, r *Ring, l net.Listener) {
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := r.Dial(l.Addr().Network(), l.Addr().String())
+	require.NoError(t, err)
+	require.NotNil(t, conn)
+	require.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+
+	data := []byte("hello dial")
+	n, err := conn.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.NoError(t, conn.Close())
+}
+
+func TestDialTCP4(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	testDialEcho(t, r, l)
+}
+
+func TestDialTCP6(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 unavailable: %v", err)
+	}
+	defer l.Close()
+
+	testDialEcho(t, r, l)
+}
+
+func TestDialUnix(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	sockFile := fmt.Sprintf("%s/dial_test_%d.sock", os.TempDir(), rand.Int())
+	l, err := net.Listen("unix", sockFile)
+	require.NoError(t, err)
+	defer l.Close()
+
+	testDialEcho(t, r, l)
+}
+
+func TestDialRefused(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	_, err = r.Dial("tcp4", addr)
+	require.Error(t, err)
+	opErr, ok := err.(*net.OpError)
+	require.True(t, ok)
+	require.Equal(t, syscall.ECONNREFUSED, opErr.Err)
+}
+
+func TestDialUnknownNetwork(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	_, err = r.Dial("ip", "127.0.0.1")
+	require.Error(t, err)
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	// A listener with a full backlog leaves connects hanging.
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fd)
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	require.NoError(t, syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	require.NoError(t, err)
+	addr := sockaddrToAddr("tcp4", sa).String()
+
+	for i := 0; i < 8; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		conn, err := r.DialContext(ctx, "tcp4", addr)
+		cancel()
+		if err != nil {
+			opErr, ok := err.(*net.OpError)
+			require.True(t, ok)
+			require.Equal(t, context.DeadlineExceeded, opErr.Err)
+			return
+		}
+		defer conn.Close()
+	}
+	t.Skip("backlog never filled")
+}
@@ -0,0 +1,138 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// direntBufSize is the size of the buffer for getdents.
+	direntBufSize = 8192
+)
+
+// dirInfo is the state of reading the entries of a directory.
+type dirInfo struct {
+	// path is the path the directory was opened with.
+	path string
+
+	mu  sync.Mutex
+	buf []byte
+	pos int
+	end int
+}
+
+// dirent is an entry of a directory.
+type dirent struct {
+	name string
+	typ  uint8
+}
+
+// readDirents returns up to n entries of the directory, or all of the
+// remaining entries if n <= 0. Like os.File.ReadDir io.EOF is only returned
+// when n > 0 and there are no more entries. There is no ring request for
+// reading directories so getdents64(2) is called directly.
+func (f *File) readDirents(n int) ([]dirent, error) {
+	if err := f.incref("readdirent"); err != nil {
+		return nil, err
+	}
+	defer f.decref()
+	d := &f.dir
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.buf == nil {
+		d.buf = make([]byte, direntBufSize)
+	}
+
+	var ents []dirent
+	for n <= 0 || len(ents) < n {
+		if d.pos >= d.end {
+			m, err := unix.Getdents(int(f.fio.fd), d.buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return ents, f.fio.pathError("readdirent", err)
+			}
+			if m <= 0 {
+				break
+			}
+			d.pos, d.end = 0, m
+		}
+		ent, reclen := parseDirent(d.buf[d.pos:d.end])
+		if reclen == 0 {
+			// A truncated entry, the kernel never returns one.
+			d.pos = d.end
+			continue
+		}
+		d.pos += reclen
+		if ent.name == "" || ent.name == "." || ent.name == ".." {
+			continue
+		}
+		ents = append(ents, ent)
+	}
+	if n > 0 && len(ents) == 0 {
+		return nil, io.EOF
+	}
+	return ents, nil
+}
+
+// parseDirent parses the linux_dirent64 at the start of buf and returns its
+// length, entries that were deleted have an empty name.
+func parseDirent(buf []byte) (dirent, int) {
+	// struct linux_dirent64 {
+	//	u64 d_ino;
+	//	s64 d_off;
+	//	u16 d_reclen;
+	//	u8  d_type;
+	//	char d_name[];
+	// };
+	const nameOff = 19
+	if len(buf) < nameOff {
+		return dirent{}, 0
+	}
+	ino := *(*uint64)(unsafe.Pointer(&buf[0]))
+	reclen := int(*(*uint16)(unsafe.Pointer(&buf[16])))
+	if reclen < nameOff || reclen > len(buf) {
+		return dirent{}, 0
+	}
+	if ino == 0 {
+		return dirent{}, reclen
+	}
+	name := buf[nameOff:reclen]
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	return dirent{name: string(name), typ: buf[18]}, reclen
+}
+
+// direntMode returns the type bits of a dirent type, ok is false if the
+// type is unknown.
+func direntMode(typ uint8) (os.FileMode, bool) {
+	switch typ {
+	case unix.DT_REG:
+		return 0, true
+	case unix.DT_DIR:
+		return os.ModeDir, true
+	case unix.DT_LNK:
+		return os.ModeSymlink, true
+	case unix.DT_BLK:
+		return os.ModeDevice, true
+	case unix.DT_CHR:
+		return os.ModeDevice | os.ModeCharDevice, true
+	case unix.DT_FIFO:
+		return os.ModeNamedPipe, true
+	case unix.DT_SOCK:
+		return os.ModeSocket, true
+	}
+	return 0, false
+}
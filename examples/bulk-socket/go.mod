@@ -8,3 +8,5 @@ require (
 	github.com/hodgesds/iouring-go v0.0.0-20200506041732-4ec64dcb5875
 	github.com/r3labs/sse v0.0.0-20200310095403-ee05428e4d0e
 )
+
+replace github.com/hodgesds/iouring-go => ../../
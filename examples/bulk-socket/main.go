@@ -8,7 +8,6 @@ import (
 	"net"
 	"net/http"
 	"time"
-	"unsafe"
 
 	gsse "github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
@@ -17,7 +16,7 @@ import (
 )
 
 var (
-	fds     = make([]int32, 0)
+	fds     = make([]int, 0)
 	message []byte
 	ring    *iouring.Ring
 )
@@ -52,7 +51,7 @@ func main() {
 
 		sf, _ := nc.(*net.TCPConn).File()
 
-		fds = append(fds, int32(sf.Fd()))
+		fds = append(fds, int(sf.Fd()))
 	})
 
 	l, err := net.Listen("tcp", ":0")
@@ -103,7 +102,7 @@ func sendMessage() {
 	}
 }
 
-func send(fds []int32, data []byte) error {
+func send(fds []int, data []byte) error {
 	fmt.Printf("Sending %d bytes to %d sockets\n", len(data), len(fds))
 
 	var b bytes.Buffer
@@ -124,22 +123,11 @@ func send(fds []int32, data []byte) error {
 	wire.Write(sdata)
 	wire.WriteString("\r\n")
 
-	rawData := wire.Bytes()
-
-	addr := (uint64)(uintptr(unsafe.Pointer(&rawData[0])))
-	length := uint32(len(rawData))
-
-	// Queue up n many SQE's for each file descriptor
-	for _, fd := range fds {
-		e, commit := ring.SubmitEntry()
-
-		e.Opcode = iouring.WriteFixed
-		e.Fd = fd
-		e.Addr = addr
-		e.Len = length
-
-		commit()
+	// Send the message to every socket with a single enter of the ring
+	for _, err := range ring.Broadcast(fds, wire.Bytes()) {
+		if err != nil {
+			return err
+		}
 	}
-
-	return ring.Enter(uint(len(fds)), uint(len(fds)), iouring.EnterGetEvents, nil)
+	return nil
 }
@@ -0,0 +1,148 @@
+// +build linux
+
+package iouring
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FallocateError is returned by the fallocate helpers when the file system
+// of the file does not support the operation.
+type FallocateError struct {
+	// Op is the operation, such as "punch hole".
+	Op string
+	// FS is the name of the file system.
+	FS string
+	// Err is the error of the fallocate request, usually EOPNOTSUPP.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *FallocateError) Error() string {
+	return fmt.Sprintf("%s is not supported by the %s file system: %v", e.Op, e.FS, e.Err)
+}
+
+// Unwrap returns the error of the fallocate request.
+func (e *FallocateError) Unwrap() error {
+	return e.Err
+}
+
+// fsNames are the names of file systems by their statfs magic number.
+var fsNames = map[int64]string{
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	0x2fc12fc1:                 "zfs",
+	0x01161970:                 "gfs2",
+	0xff534d42:                 "cifs",
+}
+
+// fsName returns the name of the file system of the fd.
+func fsName(fd int) string {
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fd, &st); err != nil {
+		return "unknown"
+	}
+	if name, ok := fsNames[int64(st.Type)]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", uint64(st.Type))
+}
+
+// fallocate does a fallocate request for one of the helpers, errors that
+// mean the file system doesn't support the mode are a *FallocateError.
+func (r *Ring) fallocate(op string, fd int, mode uint32, offset, n int64) error {
+	if offset < 0 || n <= 0 {
+		return errors.Errorf("%s: invalid offset %d and length %d", op, offset, n)
+	}
+	err := r.Fallocate(fd, mode, offset, n)
+	if err == syscall.EOPNOTSUPP {
+		return &FallocateError{Op: op, FS: fsName(fd), Err: err}
+	}
+	return err
+}
+
+// checkBlockAligned returns an error unless offset and n are multiples of the
+// block size of the file system, it also returns the size of the file.
+func (r *Ring) checkBlockAligned(op string, fd int, offset, n int64) (int64, error) {
+	var st unix.Statx_t
+	if err := r.fstatx(fd, unix.STATX_SIZE, &st); err != nil {
+		return 0, err
+	}
+	// The block size of statx is the preferred IO size, which isn't
+	// always the block size of the file system.
+	var fs unix.Statfs_t
+	if err := unix.Fstatfs(fd, &fs); err != nil {
+		return 0, err
+	}
+	bs := fs.Bsize
+	if bs > 0 && (offset%bs != 0 || n%bs != 0) {
+		return 0, errors.Errorf(
+			"%s: offset %d and length %d must be multiples of the %d byte block size",
+			op, offset, n, bs,
+		)
+	}
+	return int64(st.Size), nil
+}
+
+// PunchHole deallocates the space of n bytes at offset, the range reads as
+// zeros afterwards and the size of the file is not changed. Partial blocks
+// at the edges of the range are zeroed.
+func (r *Ring) PunchHole(fd int, offset, n int64) error {
+	return r.fallocate("punch hole", fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, n)
+}
+
+// ZeroRange zeros n bytes at offset, unlike PunchHole the space stays
+// allocated. The size of the file is not changed.
+func (r *Ring) ZeroRange(fd int, offset, n int64) error {
+	return r.fallocate("zero range", fd, unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE, offset, n)
+}
+
+// Preallocate allocates the space of n bytes at offset without changing the
+// size of the file, so that later writes to the range don't fail with
+// ENOSPC.
+func (r *Ring) Preallocate(fd int, offset, n int64) error {
+	return r.fallocate("preallocate", fd, unix.FALLOC_FL_KEEP_SIZE, offset, n)
+}
+
+// CollapseRange removes n bytes at offset from the file, the data after the
+// range is moved down and the file shrinks by n bytes. The offset and length
+// must be multiples of the block size of the file system and the range must
+// end before the end of the file.
+func (r *Ring) CollapseRange(fd int, offset, n int64) error {
+	const op = "collapse range"
+	size, err := r.checkBlockAligned(op, fd, offset, n)
+	if err != nil {
+		return err
+	}
+	if offset+n >= size {
+		return errors.Errorf("%s: range must end before the end of the file at %d", op, size)
+	}
+	return r.fallocate(op, fd, unix.FALLOC_FL_COLLAPSE_RANGE, offset, n)
+}
+
+// InsertRange inserts n bytes of hole at offset, the data after offset is
+// moved up and the file grows by n bytes. The offset and length must be
+// multiples of the block size of the file system and the offset must be
+// before the end of the file.
+func (r *Ring) InsertRange(fd int, offset, n int64) error {
+	const op = "insert range"
+	size, err := r.checkBlockAligned(op, fd, offset, n)
+	if err != nil {
+		return err
+	}
+	if offset >= size {
+		return errors.Errorf("%s: offset must be before the end of the file at %d", op, size)
+	}
+	return r.fallocate(op, fd, unix.FALLOC_FL_INSERT_RANGE, offset, n)
+}
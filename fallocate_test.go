@@ -0,0 +1,142 @@
+// +build linux
+
+package iouring
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// ext4Dir mounts an ext4 image file and returns the directory it is mounted
+// on, the test is skipped if that isn't possible.
+func ext4Dir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ext4")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	img, mnt := filepath.Join(dir, "img"), filepath.Join(dir, "mnt")
+	require.NoError(t, os.Mkdir(mnt, 0755))
+	f, err := os.Create(img)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(64<<20))
+	require.NoError(t, f.Close())
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-b", "4096", img).CombinedOutput(); err != nil {
+		t.Skipf("mkfs.ext4: %v: %s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop", img, mnt).CombinedOutput(); err != nil {
+		t.Skipf("mount: %v: %s", err, out)
+	}
+	t.Cleanup(func() { exec.Command("umount", mnt).Run() })
+	return mnt
+}
+
+// fallocateFile creates a file of 16 blocks in dir, each block is filled
+// with its index plus one.
+func fallocateFile(t *testing.T, dir string) (*os.File, []byte) {
+	f, err := ioutil.TempFile(dir, "fallocate")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	var data []byte
+	for i := 0; i < 16; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i + 1)}, 4096)...)
+	}
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	return f, data
+}
+
+func TestFallocateModes(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fileSystems := []struct {
+		name string
+		dir  func(t *testing.T) string
+		// ranges is set if the file system must support the range
+		// modes.
+		ranges bool
+	}{
+		{
+			name: "tmpfs",
+			dir: func(t *testing.T) string {
+				var st unix.Statfs_t
+				if err := unix.Statfs("/dev/shm", &st); err != nil || st.Type != unix.TMPFS_MAGIC {
+					t.Skip("/dev/shm is not a tmpfs")
+				}
+				return "/dev/shm"
+			},
+		},
+		{name: "ext4", dir: ext4Dir, ranges: true},
+	}
+	for _, fsys := range fileSystems {
+		fsys := fsys
+		t.Run(fsys.name, func(t *testing.T) {
+			dir := fsys.dir(t)
+
+			f, data := fallocateFile(t, dir)
+			fd := int(f.Fd())
+			require.NoError(t, r.PunchHole(fd, 4096+100, 8192))
+			copy(data[4096+100:], make([]byte, 8192))
+			require.NoError(t, r.Preallocate(fd, int64(len(data)), 1<<20))
+			got, err := ioutil.ReadFile(f.Name())
+			require.NoError(t, err)
+			require.Equal(t, data, got)
+
+			err = r.ZeroRange(fd, 0, 4096)
+			if fallocErr, ok := err.(*FallocateError); ok && !fsys.ranges {
+				// The range modes aren't supported so a descriptive
+				// error is returned.
+				require.Equal(t, fsys.name, fallocErr.FS)
+				require.Equal(t, syscall.EOPNOTSUPP, fallocErr.Unwrap())
+				require.Contains(t, err.Error(), "zero range is not supported by the tmpfs file system")
+				return
+			}
+			require.NoError(t, err)
+			copy(data, make([]byte, 4096))
+
+			require.NoError(t, r.CollapseRange(fd, 4096, 2*4096))
+			data = append(data[:4096], data[3*4096:]...)
+			require.NoError(t, r.InsertRange(fd, 0, 4096))
+			data = append(make([]byte, 4096), data...)
+			got, err = ioutil.ReadFile(f.Name())
+			require.NoError(t, err)
+			require.Equal(t, data, got)
+		})
+	}
+}
+
+func TestFallocateValidation(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, data := fallocateFile(t, "")
+	fd := int(f.Fd())
+	size := int64(len(data))
+
+	require.Error(t, r.PunchHole(fd, -1, 10))
+	require.Error(t, r.ZeroRange(fd, 0, 0))
+	err = r.CollapseRange(fd, 100, 4096)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "block size")
+	require.Error(t, r.CollapseRange(fd, 4096, 4095))
+	require.Error(t, r.CollapseRange(fd, size-4096, 4096))
+	require.Error(t, r.InsertRange(fd, 4096, 100))
+	require.Error(t, r.InsertRange(fd, size, 4096))
+
+	// Nothing was changed.
+	got, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
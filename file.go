@@ -0,0 +1,370 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	_ io.ReadWriteSeeker = (*File)(nil)
+	_ io.ReaderAt        = (*File)(nil)
+	_ io.WriterAt        = (*File)(nil)
+	_ io.Closer          = (*File)(nil)
+)
+
+// File is an open file that does its IO through a Ring, it is created with
+// Open or OpenFile. Reads and writes follow the semantics of an os.File and
+// the other operations, such as Stat and Sync, are also done with requests
+// on the ring.
+type File struct {
+	fio    ringFIO
+	offset int64
+	// mu protects closed, refs counts the operations that use the fd so
+	// that Close doesn't close it while their requests are in flight.
+	mu     sync.Mutex
+	closed bool
+	refs   sync.WaitGroup
+	// dir is used for reading the entries of a directory.
+	dir dirInfo
+}
+
+// Open opens the named file for reading, see OpenFile.
+func (r *Ring) Open(name string) (*File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with an openat request, the flag and perm
+// are the same as for os.OpenFile.
+func (r *Ring) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	return r.openFile(name, name, flag, perm)
+}
+
+// openFile opens the file at path, the name is used for the File and its
+// errors.
+func (r *Ring) openFile(path, name string, flag int, perm os.FileMode) (*File, error) {
+	fd, err := r.OpenAt(unix.AT_FDCWD, path, flag|syscall.O_CLOEXEC, syscallMode(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := &File{}
+	f.fio = ringFIO{
+		r:       r,
+		name:    name,
+		fd:      int32(fd),
+		fOffset: &f.offset,
+		append:  flag&os.O_APPEND != 0,
+		direct:  flag&syscall.O_DIRECT != 0,
+	}
+	f.dir.path = path
+	return f, nil
+}
+
+// syscallMode returns the mode bits for opening a file with perm.
+func syscallMode(perm os.FileMode) uint32 {
+	mode := uint32(perm.Perm())
+	if perm&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if perm&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if perm&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// incref returns an error if the file can't be used for the operation,
+// otherwise the fd is kept open until decref is called.
+func (f *File) incref(op string) error {
+	if f == nil {
+		return os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return f.fio.pathError(op, os.ErrClosed)
+	}
+	f.refs.Add(1)
+	return nil
+}
+
+// decref releases the reference of incref.
+func (f *File) decref() {
+	f.refs.Done()
+}
+
+// Name returns the name of the file as it was opened.
+func (f *File) Name() string {
+	return f.fio.name
+}
+
+// Fd returns the file descriptor of the file.
+func (f *File) Fd() uintptr {
+	if f == nil {
+		return ^uintptr(0)
+	}
+	return uintptr(f.fio.fd)
+}
+
+// Read implements the io.Reader interface.
+func (f *File) Read(b []byte) (int, error) {
+	if err := f.incref("read"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.Read(b)
+}
+
+// Write implements the io.Writer interface.
+func (f *File) Write(b []byte) (int, error) {
+	if err := f.incref("write"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.Write(b)
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.incref("read"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.ReadAt(b, off)
+}
+
+// WriteAt implements the io.WriterAt interface.
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.incref("write"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.WriteAt(b, off)
+}
+
+// Seek implements the io.Seeker interface.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if err := f.incref("seek"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.Seek(offset, whence)
+}
+
+// ReadFrom implements the io.ReaderFrom interface, data is spliced from src
+// when possible.
+func (f *File) ReadFrom(src io.Reader) (int64, error) {
+	if err := f.incref("write"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.ReadFrom(src)
+}
+
+// WriteTo implements the io.WriterTo interface, data is spliced to dst when
+// possible.
+func (f *File) WriteTo(dst io.Writer) (int64, error) {
+	if err := f.incref("read"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	return f.fio.WriteTo(dst)
+}
+
+// Stat returns the os.FileInfo of the file using a statx request, Sys
+// returns a *unix.Statx_t.
+func (f *File) Stat() (os.FileInfo, error) {
+	if err := f.incref("stat"); err != nil {
+		return nil, err
+	}
+	defer f.decref()
+	fs := &fileStat{name: filepath.Base(f.fio.name)}
+	if err := f.fio.r.fstatx(int(f.fio.fd), unix.STATX_BASIC_STATS, &fs.sys); err != nil {
+		return nil, f.fio.pathError("stat", err)
+	}
+	fs.fill()
+	return fs, nil
+}
+
+// Sync commits the contents of the file to disk with a fsync request.
+func (f *File) Sync() error {
+	if err := f.incref("sync"); err != nil {
+		return err
+	}
+	defer f.decref()
+	if err := f.fio.r.Fsync(int(f.fio.fd), 0); err != nil {
+		return f.fio.pathError("sync", err)
+	}
+	return nil
+}
+
+// Datasync is like Sync but like fdatasync(2) metadata is only flushed when
+// it is needed to read the data.
+func (f *File) Datasync() error {
+	if err := f.incref("datasync"); err != nil {
+		return err
+	}
+	defer f.decref()
+	if err := f.fio.r.Fsync(int(f.fio.fd), int(FsyncDatasync)); err != nil {
+		return f.fio.pathError("datasync", err)
+	}
+	return nil
+}
+
+// Truncate changes the size of the file, the file offset is not changed.
+// There is no ring request for truncating so ftruncate(2) is called directly.
+func (f *File) Truncate(size int64) error {
+	if err := f.incref("truncate"); err != nil {
+		return err
+	}
+	defer f.decref()
+	if err := syscall.Ftruncate(int(f.fio.fd), size); err != nil {
+		return f.fio.pathError("truncate", err)
+	}
+	return nil
+}
+
+// Allocate allocates disk space for n bytes at offset with a fallocate
+// request, the file is extended if needed.
+func (f *File) Allocate(offset, n int64) error {
+	if err := f.incref("allocate"); err != nil {
+		return err
+	}
+	defer f.decref()
+	if err := f.fio.r.Fallocate(int(f.fio.fd), 0, offset, n); err != nil {
+		return f.fio.pathError("allocate", err)
+	}
+	return nil
+}
+
+// Advise declares how n bytes at offset will be accessed with a fadvise
+// request, see the unix.FADV_* constants. A length of zero means until the
+// end of the file.
+func (f *File) Advise(offset, n int64, advice int) error {
+	if err := f.incref("fadvise"); err != nil {
+		return err
+	}
+	defer f.decref()
+	if offset < 0 || n < 0 {
+		return f.fio.pathError("fadvise", syscall.EINVAL)
+	}
+	// The length of a fadvise request is 32 bits.
+	for {
+		l := n
+		if l > math.MaxUint32 {
+			l = math.MaxUint32
+		}
+		err := f.fio.r.Fadvise(int(f.fio.fd), uint64(offset), uint32(l), advice)
+		if err != nil {
+			return f.fio.pathError("fadvise", err)
+		}
+		offset, n = offset+l, n-l
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// Close closes the file with a close request. Like os.File it waits for
+// the operations that are in progress, so that the fd isn't closed while
+// they still use it.
+func (f *File) Close() error {
+	if f == nil {
+		return os.ErrInvalid
+	}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return f.fio.pathError("close", os.ErrClosed)
+	}
+	f.closed = true
+	f.mu.Unlock()
+	f.refs.Wait()
+	return f.fio.Close()
+}
+
+// fstatx is used to statx an open fd.
+func (r *Ring) fstatx(fd int, mask int, statx *unix.Statx_t) error {
+	// The path must be an empty string rather than NULL for older kernels.
+	path := []byte{0}
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepStatx(sqe, fd, &path[0], unix.AT_EMPTY_PATH, mask, statx)
+	})
+	runtime.KeepAlive(path)
+	runtime.KeepAlive(statx)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+// fileStat is an os.FileInfo for a statx result.
+type fileStat struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	sys     unix.Statx_t
+}
+
+// fill sets the fields from the statx result.
+func (fs *fileStat) fill() {
+	fs.size = int64(fs.sys.Size)
+	fs.modTime = time.Unix(fs.sys.Mtime.Sec, int64(fs.sys.Mtime.Nsec))
+	fs.mode = os.FileMode(fs.sys.Mode & 0777)
+	switch uint32(fs.sys.Mode) & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		fs.mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		fs.mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		fs.mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		fs.mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		fs.mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		fs.mode |= os.ModeSocket
+	}
+	if fs.sys.Mode&syscall.S_ISGID != 0 {
+		fs.mode |= os.ModeSetgid
+	}
+	if fs.sys.Mode&syscall.S_ISUID != 0 {
+		fs.mode |= os.ModeSetuid
+	}
+	if fs.sys.Mode&syscall.S_ISVTX != 0 {
+		fs.mode |= os.ModeSticky
+	}
+}
+
+// Name implements the os.FileInfo interface.
+func (fs *fileStat) Name() string { return fs.name }
+
+// Size implements the os.FileInfo interface.
+func (fs *fileStat) Size() int64 { return fs.size }
+
+// Mode implements the os.FileInfo interface.
+func (fs *fileStat) Mode() os.FileMode { return fs.mode }
+
+// ModTime implements the os.FileInfo interface.
+func (fs *fileStat) ModTime() time.Time { return fs.modTime }
+
+// IsDir implements the os.FileInfo interface.
+func (fs *fileStat) IsDir() bool { return fs.mode.IsDir() }
+
+// Sys implements the os.FileInfo interface, it returns a *unix.Statx_t.
+func (fs *fileStat) Sys() interface{} { return &fs.sys }
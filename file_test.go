@@ -0,0 +1,176 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test")
+
+	f, err := r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	require.NoError(t, err)
+	require.Equal(t, name, f.Name())
+
+	content := []byte("hello io_uring")
+	n, err := f.Write(content)
+	require.NoError(t, err)
+	require.Equal(t, len(content), n)
+	off, err := f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), off)
+	b, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+
+	b = make([]byte, 7)
+	_, err = f.ReadAt(b, 6)
+	require.NoError(t, err)
+	require.Equal(t, "io_urin", string(b))
+	_, err = f.WriteAt([]byte("HELLO"), 0)
+	require.NoError(t, err)
+
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, "test", fi.Name())
+	require.Equal(t, int64(len(content)), fi.Size())
+	require.Equal(t, os.FileMode(0640)&^fileUmask(), fi.Mode())
+	require.False(t, fi.IsDir())
+	want, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, want.ModTime(), fi.ModTime())
+	require.IsType(t, &unix.Statx_t{}, fi.Sys())
+
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Datasync())
+	require.NoError(t, f.Advise(0, 0, unix.FADV_SEQUENTIAL))
+	require.NoError(t, f.Allocate(0, 1<<20))
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), fi.Size())
+	require.NoError(t, f.Truncate(5))
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), fi.Size())
+
+	require.NoError(t, f.Close())
+	err = f.Close()
+	require.Error(t, err)
+	require.Equal(t, os.ErrClosed, err.(*os.PathError).Err)
+	_, err = f.Read(b)
+	require.Error(t, err)
+
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(data))
+}
+
+func TestOpen(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	src, data := spliceFile(t, 1<<20+77)
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	f, err := r.Open(src.Name())
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("x"))
+	require.Error(t, err)
+
+	// WriteTo splices the file.
+	dst, err := ioutil.TempFile("", "file")
+	require.NoError(t, err)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	n, err := io.Copy(dst, f)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	got, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	dir, err := r.Open(os.TempDir())
+	require.NoError(t, err)
+	defer dir.Close()
+	fi, err := dir.Stat()
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	_, err = r.Open(filepath.Join(os.TempDir(), "does", "not", "exist"))
+	require.Error(t, err)
+	require.True(t, os.IsNotExist(err))
+	pathErr, ok := err.(*os.PathError)
+	require.True(t, ok)
+	require.Equal(t, "open", pathErr.Op)
+}
+
+// fileUmask returns the umask of the process.
+func fileUmask() os.FileMode {
+	mask := unix.Umask(0)
+	unix.Umask(mask)
+	return os.FileMode(mask)
+}
+
+func TestFileCloseWaits(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fifo")
+	require.NoError(t, syscall.Mkfifo(name, 0644))
+
+	// The read is in flight until the fifo is written to, Close doesn't
+	// close the fd before then.
+	f, err := r.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	read := make(chan error, 1)
+	b := make([]byte, 5)
+	go func() {
+		_, err := f.Read(b)
+		read <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- f.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a read was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w, err := os.OpenFile(name, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, <-read)
+	require.Equal(t, "hello", string(b))
+	require.NoError(t, <-closed)
+	_, err = f.Read(b)
+	require.Equal(t, os.ErrClosed, err.(*os.PathError).Err)
+}
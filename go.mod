@@ -5,5 +5,6 @@ go 1.12
 require (
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
+	golang.org/x/net v0.1.0
+	golang.org/x/sys v0.1.0
 )
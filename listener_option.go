@@ -0,0 +1,63 @@
+// +build linux
+
+package iouring
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ListenerOption is an option for configuring a Ring based net.Listener.
+type ListenerOption func(*ringListener) error
+
+// WithListenerErrHandler is used to handle errors from accepting connections,
+// the errors are also returned from Accept.
+func WithListenerErrHandler(f func(error)) ListenerOption {
+	return func(l *ringListener) error {
+		l.errHandler = f
+		return nil
+	}
+}
+
+// WithSockopts is used to set socket options on the listening socket, see
+// SOReuseport and TCPFastopen.
+func WithSockopts(sockopts ...int) ListenerOption {
+	return func(l *ringListener) error {
+		l.sockopts = append(l.sockopts, sockopts...)
+		return nil
+	}
+}
+
+// WithAccepts is used to set the number of accept requests that are kept in
+// flight on the ring, the default is one.
+func WithAccepts(n int) ListenerOption {
+	return func(l *ringListener) error {
+		if n < 1 {
+			return errors.New("accepts must be greater than zero")
+		}
+		l.accepts = n
+		return nil
+	}
+}
+
+// WithUnlinkStale is used to remove the file of a Unix socket that nothing is
+// listening on before binding to it, otherwise binding fails with
+// EADDRINUSE when a previous listener was not closed cleanly.
+func WithUnlinkStale() ListenerOption {
+	return func(l *ringListener) error {
+		l.unlinkStale = true
+		return nil
+	}
+}
+
+// WithMaxConns is used to limit the number of open connections that were
+// accepted by the listener. Once the limit is reached no more connections are
+// accepted until one of the connections is closed.
+func WithMaxConns(n int) ListenerOption {
+	return func(l *ringListener) error {
+		if n < 1 {
+			return errors.New("max conns must be greater than zero")
+		}
+		l.conns = make(chan struct{}, n)
+		return nil
+	}
+}
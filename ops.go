@@ -3,7 +3,9 @@
 package iouring
 
 import (
+	"context"
 	"encoding/binary"
+	"io"
 	"runtime"
 	"syscall"
 	"unsafe"
@@ -16,103 +18,232 @@ var (
 	errRingUnavailable = errors.New("ring unavailable")
 )
 
-// PrepareAccept is used to prepare a SQE for an accept(2) call.
+// ctxErr returns the context error if the errno is the result of the context
+// canceling the request.
+func ctxErr(ctx context.Context, errno syscall.Errno) error {
+	if ctx.Err() != nil && (errno == syscall.ECANCELED || errno == syscall.EINTR) {
+		return ctx.Err()
+	}
+	return errno
+}
+
+// PrepareAccept is used to prepare a SQE for an accept(2) call. The address
+// of the peer is written to addr and socklen must be set to the size of addr.
+// Both must not be modified until the request has completed.
 func (r *Ring) PrepareAccept(
 	fd int,
-	addr syscall.Sockaddr,
-	socklen uint32,
+	addr *syscall.RawSockaddrAny,
+	socklen *uint32,
 	flags int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
+	var v interface{}
+	if addr != nil {
+		v = []interface{}{addr, socklen}
 	}
+	return r.prepare(v, func(sqe *SubmitEntry) {
+		prepAccept(sqe, fd, addr, socklen, flags)
+	})
+}
 
+// prepAccept prepares an accept of the fd.
+func prepAccept(sqe *SubmitEntry, fd int, addr *syscall.RawSockaddrAny, socklen *uint32, flags int) {
 	sqe.Opcode = Accept
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&addr)))
-	sqe.Offset = uint64(socklen)
+	if addr != nil {
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(addr)))
+		sqe.Offset = (uint64)(uintptr(unsafe.Pointer(socklen)))
+	}
 	sqe.UFlags = int32(flags)
+}
 
-	ready()
-	return sqe.UserData, nil
+// Accept implements accept4(2) using the ring and returns the file descriptor
+// of the accepted connection along with the address of the peer.
+func (r *Ring) Accept(fd int, flags int) (int, syscall.Sockaddr, error) {
+	var (
+		rsa     syscall.RawSockaddrAny
+		socklen = uint32(syscall.SizeofSockaddrAny)
+	)
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepAccept(sqe, fd, &rsa, &socklen, flags)
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+	if res < 0 {
+		return -1, nil, syscall.Errno(-res)
+	}
+	sa, err := anyToSockaddr(&rsa, socklen)
+	if err != nil {
+		syscall.Close(int(res))
+		return -1, nil, err
+	}
+	return int(res), sa, nil
+}
+
+// PrepareAsyncCancel is used to prepare a SQE that cancels the in flight
+// request with the given request id.
+func (r *Ring) PrepareAsyncCancel(reqID uint64, flags int) (uint64, error) {
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepAsyncCancel(sqe, reqID, flags)
+	})
+}
+
+// prepAsyncCancel prepares a cancel of the request with the id.
+func prepAsyncCancel(sqe *SubmitEntry, reqID uint64, flags int) {
+	sqe.Opcode = AsyncCancel
+	sqe.Fd = -1
+	sqe.Addr = reqID
+	sqe.UFlags = int32(flags)
+}
+
+// AsyncCancel is used to cancel an in flight request.
+func (r *Ring) AsyncCancel(reqID uint64, flags int) error {
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepAsyncCancel(sqe, reqID, flags)
+	})
+	if err != nil {
+		return err
+	}
+	if errno < 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
 }
 
 // PrepareClose is used to prepare a close(2) call.
 func (r *Ring) PrepareClose(fd int) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepClose(sqe, fd)
+	})
+}
+
+// prepClose prepares a close of the fd.
+func prepClose(sqe *SubmitEntry, fd int) {
 	sqe.Opcode = Close
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
-
-	ready()
-	return sqe.UserData, nil
 }
 
 // Close is implements close(2).
 func (r *Ring) Close(fd int) error {
-	id, err := r.PrepareClose(fd)
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepClose(sqe, fd)
+	})
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
 	return nil
 }
 
-// PrepareConnect is used to prepare a SQE for a connect(2) call.
+// PrepareShutdown is used to prepare a shutdown(2) call.
+func (r *Ring) PrepareShutdown(fd int, how int) (uint64, error) {
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepShutdown(sqe, fd, how)
+	})
+}
+
+// prepShutdown prepares a shutdown of the fd.
+func prepShutdown(sqe *SubmitEntry, fd int, how int) {
+	sqe.Opcode = Shutdown
+	sqe.Fd = int32(fd)
+	sqe.Len = uint32(how)
+}
+
+// Shutdown implements shutdown(2), how is one of syscall.SHUT_RD,
+// syscall.SHUT_WR or syscall.SHUT_RDWR.
+func (r *Ring) Shutdown(fd int, how int) error {
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepShutdown(sqe, fd, how)
+	})
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+// PrepareConnect is used to prepare a SQE for a connect(2) call. If socklen is
+// zero the length of the address is used.
 func (r *Ring) PrepareConnect(
 	fd int,
 	addr syscall.Sockaddr,
 	socklen uint32,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
+	rsa, n, err := rawSockaddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	if socklen == 0 || socklen > n {
+		socklen = n
 	}
+	return r.prepare(rsa, func(sqe *SubmitEntry) {
+		prepConnect(sqe, fd, rsa, socklen)
+	})
+}
 
+// prepConnect prepares a connect of the fd to the raw address.
+func prepConnect(sqe *SubmitEntry, fd int, rsa *syscall.RawSockaddrAny, socklen uint32) {
 	sqe.Opcode = Connect
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&addr)))
-	sqe.Len = socklen
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(rsa)))
+	sqe.Offset = uint64(socklen)
+}
+
+// Connect implements connect(2) using the ring.
+func (r *Ring) Connect(fd int, addr syscall.Sockaddr) error {
+	return r.ConnectContext(context.Background(), fd, addr)
+}
 
-	ready()
-	return sqe.UserData, nil
+// ConnectContext is like Connect, only the connect is canceled when the
+// context is done.
+func (r *Ring) ConnectContext(
+	ctx context.Context, fd int, addr syscall.Sockaddr) error {
+	rsa, socklen, err := rawSockaddr(addr)
+	if err != nil {
+		return err
+	}
+	errno, _, err := r.completeCtx(ctx, func(sqe *SubmitEntry) {
+		prepConnect(sqe, fd, rsa, socklen)
+	})
+	runtime.KeepAlive(rsa)
+	if err != nil {
+		return err
+	}
+	if errno < 0 {
+		return ctxErr(ctx, syscall.Errno(-errno))
+	}
+	return nil
 }
 
 // PrepareFadvise is used to prepare a fadvise call.
 func (r *Ring) PrepareFadvise(
 	fd int, offset uint64, n uint32, advise int) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepFadvise(sqe, fd, offset, n, advise)
+	})
+}
 
+// prepFadvise prepares a fadvise of the fd.
+func prepFadvise(sqe *SubmitEntry, fd int, offset uint64, n uint32, advise int) {
 	sqe.Opcode = Fadvise
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
 	sqe.Len = n
 	sqe.Offset = offset
 	sqe.UFlags = int32(advise)
-
-	ready()
-	return sqe.UserData, nil
 }
 
 // Fadvise implements fadvise.
 func (r *Ring) Fadvise(fd int, offset uint64, n uint32, advise int) error {
-	id, err := r.PrepareFadvise(fd, offset, n, advise)
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepFadvise(sqe, fd, offset, n, advise)
+	})
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
@@ -122,29 +253,28 @@ func (r *Ring) Fadvise(fd int, offset uint64, n uint32, advise int) error {
 // PrepareFallocate is used to prepare a fallocate call.
 func (r *Ring) PrepareFallocate(
 	fd int, mode uint32, offset int64, n int64) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepFallocate(sqe, fd, mode, offset, n)
+	})
+}
 
+// prepFallocate prepares a fallocate of the fd.
+func prepFallocate(sqe *SubmitEntry, fd int, mode uint32, offset int64, n int64) {
 	sqe.Opcode = Fallocate
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
 	sqe.Addr = uint64(n)
 	sqe.Len = mode
 	sqe.Offset = uint64(offset)
-
-	ready()
-	return sqe.UserData, nil
 }
 
 // Fallocate implements fallocate.
 func (r *Ring) Fallocate(fd int, mode uint32, offset int64, n int64) error {
-	id, err := r.PrepareFallocate(fd, mode, offset, n)
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepFallocate(sqe, fd, mode, offset, n)
+	})
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
@@ -153,26 +283,26 @@ func (r *Ring) Fallocate(fd int, mode uint32, offset int64, n int64) error {
 
 // PrepareFsync is used to prepare a fsync(2) call.
 func (r *Ring) PrepareFsync(fd int, flags int) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepFsync(sqe, fd, flags)
+	})
+}
+
+// prepFsync prepares a fsync of the fd.
+func prepFsync(sqe *SubmitEntry, fd int, flags int) {
 	sqe.Opcode = Fsync
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
 	sqe.UFlags = int32(flags)
-
-	ready()
-	return sqe.UserData, nil
 }
 
 // Fsync implements fsync(2).
 func (r *Ring) Fsync(fd int, flags int) error {
-	id, err := r.PrepareFsync(fd, flags)
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepFsync(sqe, fd, flags)
+	})
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
@@ -181,38 +311,167 @@ func (r *Ring) Fsync(fd int, flags int) error {
 
 // PrepareNop is used to prep a nop.
 func (r *Ring) PrepareNop() (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(nil, prepNop)
+}
+
+// prepNop prepares a nop.
+func prepNop(sqe *SubmitEntry) {
 	sqe.Opcode = Nop
-	sqe.UserData = r.ID()
 	sqe.Fd = -1
-
-	ready()
-	return sqe.UserData, nil
 }
 
 // Nop is a nop.
 func (r *Ring) Nop() error {
-	id, err := r.PrepareNop()
+	errno, _, err := r.complete(prepNop)
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
 	return nil
 }
 
+// PrepareOpenAt is used to prepare an openat(2) call, the path is copied so
+// it doesn't need to be kept alive.
+func (r *Ring) PrepareOpenAt(
+	dirfd int, path string, flags int, mode uint32) (uint64, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	return r.prepare(p, func(sqe *SubmitEntry) {
+		prepOpenAt(sqe, dirfd, p, flags, mode)
+	})
+}
+
+// prepOpenAt prepares an openat of the NUL terminated path.
+func prepOpenAt(sqe *SubmitEntry, dirfd int, path *byte, flags int, mode uint32) {
+	sqe.Opcode = OpenAt
+	sqe.Fd = int32(dirfd)
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(path)))
+	sqe.Len = mode
+	sqe.UFlags = int32(flags)
+}
+
+// OpenAt implements openat(2), it returns the opened fd.
+func (r *Ring) OpenAt(dirfd int, path string, flags int, mode uint32) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepOpenAt(sqe, dirfd, p, flags, mode)
+	})
+	runtime.KeepAlive(p)
+	if err != nil {
+		return -1, err
+	}
+	if res < 0 {
+		return -1, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// PrepareRenameAt is used to prepare a renameat2(2) call, the paths are
+// copied so they don't need to be kept alive.
+func (r *Ring) PrepareRenameAt(
+	olddirfd int, oldpath string, newdirfd int, newpath string, flags int) (uint64, error) {
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return 0, err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return 0, err
+	}
+	return r.prepare([2]*byte{oldp, newp}, func(sqe *SubmitEntry) {
+		prepRenameAt(sqe, olddirfd, oldp, newdirfd, newp, flags)
+	})
+}
+
+// prepRenameAt prepares a renameat of the NUL terminated paths.
+func prepRenameAt(sqe *SubmitEntry, olddirfd int, oldpath *byte, newdirfd int, newpath *byte, flags int) {
+	sqe.Opcode = RenameAt
+	sqe.Fd = int32(olddirfd)
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(oldpath)))
+	sqe.Len = uint32(newdirfd)
+	// The new path is in addr2, which shares the offset field.
+	sqe.Offset = (uint64)(uintptr(unsafe.Pointer(newpath)))
+	sqe.UFlags = int32(flags)
+}
+
+// RenameAt implements renameat2(2).
+func (r *Ring) RenameAt(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error {
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepRenameAt(sqe, olddirfd, oldp, newdirfd, newp, flags)
+	})
+	runtime.KeepAlive(oldp)
+	runtime.KeepAlive(newp)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+// PrepareUnlinkAt is used to prepare an unlinkat(2) call, the path is copied
+// so it doesn't need to be kept alive.
+func (r *Ring) PrepareUnlinkAt(dirfd int, path string, flags int) (uint64, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	return r.prepare(p, func(sqe *SubmitEntry) {
+		prepUnlinkAt(sqe, dirfd, p, flags)
+	})
+}
+
+// prepUnlinkAt prepares an unlinkat of the NUL terminated path.
+func prepUnlinkAt(sqe *SubmitEntry, dirfd int, path *byte, flags int) {
+	sqe.Opcode = UnlinkAt
+	sqe.Fd = int32(dirfd)
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(path)))
+	sqe.UFlags = int32(flags)
+}
+
+// UnlinkAt implements unlinkat(2).
+func (r *Ring) UnlinkAt(dirfd int, path string, flags int) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepUnlinkAt(sqe, dirfd, p, flags)
+	})
+	runtime.KeepAlive(p)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
 // PollAdd is used to add a poll to a fd.
 func (r *Ring) PollAdd(fd int, mask int) error {
-	id, err := r.PreparePollAdd(fd, mask)
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepPollAdd(sqe, fd, mask)
+	})
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
@@ -221,39 +480,39 @@ func (r *Ring) PollAdd(fd int, mask int) error {
 
 // PreparePollAdd is used to prepare a SQE for adding a poll.
 func (r *Ring) PreparePollAdd(fd int, mask int) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepPollAdd(sqe, fd, mask)
+	})
+}
+
+// prepPollAdd prepares a poll of the fd for the events in mask.
+func prepPollAdd(sqe *SubmitEntry, fd int, mask int) {
 	sqe.Opcode = PollAdd
 	sqe.Fd = int32(fd)
 	sqe.UFlags = int32(mask)
-	sqe.UserData = r.ID()
-
-	ready()
-	return sqe.UserData, nil
 }
 
-// PrepareReadv is used to prepare a readv SQE.
+// PrepareReadv is used to prepare a readv SQE, the iovecs and the buffers they
+// point to are kept alive until the request completes.
 func (r *Ring) PrepareReadv(
 	fd int,
-	iovecs []*syscall.Iovec,
+	iovecs []syscall.Iovec,
 	offset int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(iovecs, func(sqe *SubmitEntry) {
+		prepIovecs(sqe, Readv, fd, iovecs, offset)
+	})
+}
 
-	sqe.Opcode = Readv
-	sqe.UserData = r.ID()
+// prepIovecs prepares a readv or writev of the iovecs on the fd.
+func prepIovecs(sqe *SubmitEntry, op Opcode, fd int, iovecs []syscall.Iovec, offset int) {
+	sqe.Opcode = op
 	sqe.Fd = int32(fd)
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&iovecs[0])))
 	sqe.Len = uint32(len(iovecs))
 	sqe.Offset = uint64(offset)
-
-	ready()
-	return sqe.UserData, nil
+	if len(iovecs) > 0 {
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&iovecs[0])))
+	}
 }
 
 // PrepareRecvmsg is used to prepare a recvmsg SQE.
@@ -262,24 +521,42 @@ func (r *Ring) PrepareRecvmsg(
 	msg *syscall.Msghdr,
 	flags int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(msg, func(sqe *SubmitEntry) {
+		prepRecvmsg(sqe, fd, msg, flags)
+	})
+}
 
+// prepRecvmsg prepares a recvmsg of the msghdr on the fd.
+func prepRecvmsg(sqe *SubmitEntry, fd int, msg *syscall.Msghdr, flags int) {
 	sqe.Opcode = RecvMsg
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
 	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(msg)))
 	sqe.Len = 1
-	sqe.Offset = 0
 	sqe.UFlags = int32(flags)
+}
 
-	ready()
-	return sqe.UserData, nil
+// PrepareSendmsg is used to prepare a sendmsg SQE.
+func (r *Ring) PrepareSendmsg(
+	fd int,
+	msg *syscall.Msghdr,
+	flags int,
+) (uint64, error) {
+	return r.prepare(msg, func(sqe *SubmitEntry) {
+		prepSendmsg(sqe, fd, msg, flags)
+	})
 }
 
-// Splice implements splice using a ring.
+// prepSendmsg prepares a sendmsg of the msghdr on the fd.
+func prepSendmsg(sqe *SubmitEntry, fd int, msg *syscall.Msghdr, flags int) {
+	sqe.Opcode = SendMsg
+	sqe.Fd = int32(fd)
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(msg)))
+	sqe.Len = 1
+	sqe.UFlags = int32(flags)
+}
+
+// Splice implements splice using a ring. Like splice(2) the offsets are
+// advanced by the number of bytes spliced, a nil offset uses the file offset.
 func (r *Ring) Splice(
 	inFd int,
 	inOff *int64,
@@ -288,21 +565,26 @@ func (r *Ring) Splice(
 	n int,
 	flags int,
 ) (int64, error) {
-	id, err := r.PrepareSplice(inFd, inOff, outFd, outOff, n, flags)
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepSplice(sqe, inFd, spliceOffset(inOff), outFd, spliceOffset(outOff), n, flags)
+	})
 	if err != nil {
 		return 0, err
 	}
-	// TODO: replace complete with something more efficient.
-	errno, res := r.complete(id)
-	if errno < 0 {
-		return 0, syscall.Errno(-errno)
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	if inOff != nil {
+		*inOff += int64(res)
+	}
+	if outOff != nil {
+		*outOff += int64(res)
 	}
-	runtime.KeepAlive(inOff)
-	runtime.KeepAlive(outOff)
 	return int64(res), nil
 }
 
-// PrepareSplice is used to prepare a SQE for a splice(2).
+// PrepareSplice is used to prepare a SQE for a splice(2). The offsets are
+// read when the SQE is prepared.
 func (r *Ring) PrepareSplice(
 	inFd int,
 	inOff *int64,
@@ -311,33 +593,44 @@ func (r *Ring) PrepareSplice(
 	n int,
 	flags int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
+	inOffset, outOffset := spliceOffset(inOff), spliceOffset(outOff)
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		prepSplice(sqe, inFd, inOffset, outFd, outOffset, n, flags)
+	})
+}
+
+// spliceOffset returns the offset value for a splice SQE, -1 means the fd
+// has no offset or the current file offset is used.
+func spliceOffset(off *int64) int64 {
+	if off == nil {
+		return -1
 	}
+	return *off
+}
 
+func prepSplice(
+	sqe *SubmitEntry,
+	inFd int,
+	inOff int64,
+	outFd int,
+	outOff int64,
+	n int,
+	flags int,
+) {
 	sqe.Opcode = Splice
 	sqe.Fd = int32(outFd)
-	if inOff != nil {
-		sqe.Addr = uint64(uintptr(unsafe.Pointer(&inOff)))
-	} else {
-		sqe.Addr = 0
-	}
+	sqe.Offset = uint64(outOff)
+	sqe.Addr = uint64(inOff)
 	sqe.Len = uint32(n)
-	if outOff != nil {
-		sqe.Offset = uint64(uintptr(unsafe.Pointer(&outOff)))
-	} else {
-		sqe.Offset = 0
-	}
 	sqe.UFlags = int32(flags)
-	// BUG: need to convert the inFd to the union member of the SQE
-	anon := [24]byte{}
-	binary.LittleEndian.PutUint32(anon[4:], uint32(inFd))
-	sqe.Anon0 = anon
-	sqe.UserData = r.ID()
+	// splice_fd_in follows the buf_index and personality fields.
+	binary.LittleEndian.PutUint32(sqe.Anon0[4:], uint32(inFd))
+}
 
-	ready()
-	return sqe.UserData, nil
+// setBufIndex sets the index of the fixed buffer used by a request.
+func setBufIndex(sqe *SubmitEntry, index uint16) {
+	// buf_index is the first field after user_data.
+	binary.LittleEndian.PutUint16(sqe.Anon0[0:], index)
 }
 
 // Statx implements statx using a ring.
@@ -348,17 +641,20 @@ func (r *Ring) Statx(
 	mask int,
 	statx *unix.Statx_t,
 ) (err error) {
-	id, err := r.PrepareStatx(dirfd, path, flags, mask, statx)
+	// The kernel reads the path until the NUL byte.
+	p, err := syscall.BytePtrFromString(path)
 	if err != nil {
 		return err
 	}
-	errno, _ := r.complete(id)
+	errno, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepStatx(sqe, dirfd, p, flags, mask, statx)
+	})
 	// No GC until the request is done.
 	runtime.KeepAlive(statx)
-	runtime.KeepAlive(dirfd)
-	runtime.KeepAlive(path)
-	runtime.KeepAlive(mask)
-	runtime.KeepAlive(flags)
+	runtime.KeepAlive(p)
+	if err != nil {
+		return err
+	}
 	if errno < 0 {
 		return syscall.Errno(-errno)
 	}
@@ -375,64 +671,62 @@ func (r *Ring) PrepareStatx(
 	mask int,
 	statx *unix.Statx_t,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
+	// The kernel reads the path until the NUL byte.
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
 	}
+	return r.prepare([]interface{}{p, statx}, func(sqe *SubmitEntry) {
+		prepStatx(sqe, dirfd, p, flags, mask, statx)
+	})
+}
 
+// prepStatx prepares a statx of the NUL terminated path.
+func prepStatx(sqe *SubmitEntry, dirfd int, path *byte, flags, mask int, statx *unix.Statx_t) {
 	sqe.Opcode = Statx
 	sqe.Fd = int32(dirfd)
-	if path != "" {
-		// TODO: could probably avoid the conversion to []byte
-		b := saferStringToBytes(&path)
-		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-	}
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(path)))
 	sqe.Len = uint32(mask)
 	sqe.Offset = (uint64)(uintptr(unsafe.Pointer(statx)))
 	sqe.UFlags = int32(flags)
-	sqe.UserData = r.ID()
-
-	ready()
-	return sqe.UserData, nil
 }
 
 // PrepareTimeout is used to prepare a timeout SQE.
 func (r *Ring) PrepareTimeout(
 	ts *syscall.Timespec, count int, flags int) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(ts, func(sqe *SubmitEntry) {
+		prepTimeout(sqe, ts, count, flags)
+	})
+}
 
+// prepTimeout prepares a timeout that completes after ts or once count
+// requests have completed.
+func prepTimeout(sqe *SubmitEntry, ts *syscall.Timespec, count int, flags int) {
 	sqe.Opcode = Timeout
-	sqe.UserData = r.ID()
 	sqe.UFlags = int32(flags)
 	sqe.Fd = -1
 	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(ts)))
 	sqe.Len = 1
 	sqe.Offset = uint64(count)
+}
 
-	ready()
-	return sqe.UserData, nil
+// prepLinkTimeout prepares a timeout of ts for the request that the SQE is
+// linked to.
+func prepLinkTimeout(sqe *SubmitEntry, ts *syscall.Timespec) {
+	sqe.Opcode = LinkTimeout
+	sqe.Fd = -1
+	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(ts)))
+	sqe.Len = 1
 }
 
 // PrepareTimeoutRemove is used to prepare a timeout removal.
 func (r *Ring) PrepareTimeoutRemove(data uint64, flags int) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
-
-	sqe.Opcode = TimeoutRemove
-	sqe.UserData = r.ID()
-	sqe.UFlags = int32(flags)
-	sqe.Fd = -1
-	sqe.Addr = data
-	sqe.Len = 0
-	sqe.Offset = 0
-
-	ready()
-	return sqe.UserData, nil
+	return r.prepare(nil, func(sqe *SubmitEntry) {
+		sqe.Opcode = TimeoutRemove
+		sqe.UFlags = int32(flags)
+		sqe.Fd = -1
+		sqe.Addr = data
+	})
 }
 
 // PrepareRead is used to prepare a read SQE.
@@ -442,43 +736,36 @@ func (r *Ring) PrepareRead(
 	offset uint64,
 	flags uint8,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(b, func(sqe *SubmitEntry) {
+		prepBuf(sqe, Read, fd, b, offset, flags)
+	})
+}
 
-	sqe.Opcode = Read
-	sqe.UserData = r.ID()
+// prepBuf prepares a read or write of b on the fd, flags are the SQE flags.
+func prepBuf(sqe *SubmitEntry, op Opcode, fd int, b []byte, offset uint64, flags uint8) {
+	sqe.Opcode = op
 	sqe.Fd = int32(fd)
 	sqe.Len = uint32(len(b))
 	sqe.Flags = flags
 	sqe.Offset = offset
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-	return sqe.UserData, nil
+	if len(b) > 0 {
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
+	}
 }
 
-// PrepareReadFixed is used to prepare a fixed read SQE.
+// PrepareReadFixed is used to prepare a fixed read SQE, b must be within the
+// registered buffer with the index.
 func (r *Ring) PrepareReadFixed(
 	fd int,
 	b []byte,
+	offset uint64,
+	index uint16,
 	flags uint8,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
-
-	sqe.Opcode = ReadFixed
-	sqe.UserData = r.ID()
-	sqe.Fd = int32(fd)
-	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-	return sqe.UserData, nil
+	return r.prepare(b, func(sqe *SubmitEntry) {
+		prepBuf(sqe, ReadFixed, fd, b, offset, flags)
+		setBufIndex(sqe, index)
+	})
 }
 
 // PrepareWrite is used to prepare a Write SQE.
@@ -488,145 +775,170 @@ func (r *Ring) PrepareWrite(
 	offset uint64,
 	flags uint8,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
-
-	sqe.Opcode = Write
-	sqe.UserData = r.ID()
-	sqe.Fd = int32(fd)
-	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Offset = offset
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-	return sqe.UserData, nil
+	return r.prepare(b, func(sqe *SubmitEntry) {
+		prepBuf(sqe, Write, fd, b, offset, flags)
+	})
 }
 
-// PrepareWriteFixed is used to prepare a fixed write SQE.
+// PrepareWriteFixed is used to prepare a fixed write SQE, b must be within the
+// registered buffer with the index.
 func (r *Ring) PrepareWriteFixed(
 	fd int,
 	b []byte,
+	offset uint64,
+	index uint16,
 	flags uint8,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
-
-	sqe.Opcode = WriteFixed
-	sqe.UserData = r.ID()
-	sqe.Fd = int32(fd)
-	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-	return sqe.UserData, nil
+	return r.prepare(b, func(sqe *SubmitEntry) {
+		prepBuf(sqe, WriteFixed, fd, b, offset, flags)
+		setBufIndex(sqe, index)
+	})
 }
 
-// PrepareWritev is used to prepare a writev SQE.
+// PrepareWritev is used to prepare a writev SQE, the iovecs and the buffers they
+// point to are kept alive until the request completes.
 func (r *Ring) PrepareWritev(
 	fd int,
-	iovecs []*syscall.Iovec,
+	iovecs []syscall.Iovec,
 	offset int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
-
-	sqe.Opcode = Writev
-	sqe.UserData = r.ID()
-	sqe.Fd = int32(fd)
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&iovecs[0])))
-	sqe.Len = uint32(len(iovecs))
-	sqe.Offset = uint64(offset)
-
-	ready()
-	return sqe.UserData, nil
+	return r.prepare(iovecs, func(sqe *SubmitEntry) {
+		prepIovecs(sqe, Writev, fd, iovecs, offset)
+	})
 }
 
-// PrepareSend is used to prepare a Send SQE.
+// PrepareSend is used to prepare a Send SQE, flags are the MSG_* flags of
+// send(2).
 func (r *Ring) PrepareSend(
 	fd int,
 	b []byte,
-	flags uint8,
+	flags int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(b, func(sqe *SubmitEntry) {
+		prepSend(sqe, fd, b, flags)
+	})
+}
 
+// prepSend prepares a send of b on the fd.
+func prepSend(sqe *SubmitEntry, fd int, b []byte, flags int) {
 	sqe.Opcode = Send
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
 	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-	return sqe.UserData, nil
+	sqe.UFlags = int32(flags)
+	if len(b) > 0 {
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
+	}
 }
 
-// Send is used to send data to a socket.
+// Send is used to send data to a socket, it returns the number of bytes
+// sent which may be less than len(b).
 func (r *Ring) Send(
 	fd int,
 	b []byte,
-	flags uint8,
-) error {
-	id, err := r.PrepareSend(fd, b, flags)
-	if err != nil {
-		return err
-	}
-	errno, _ := r.complete(id)
+	flags int,
+) (int, error) {
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepSend(sqe, fd, b, flags)
+	})
 	// No GC until the request is done.
 	runtime.KeepAlive(b)
-	if errno < 0 {
-		return syscall.Errno(-errno)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// SendAll is used to send all of b to a socket, sends are repeated until
+// everything is sent or an error occurs. It returns the number of bytes
+// sent, a send that makes no progress fails with io.ErrShortWrite.
+func (r *Ring) SendAll(
+	fd int,
+	b []byte,
+	flags int,
+) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := r.Send(fd, b[n:], flags)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
 }
 
-// PrepareRecv is used to prepare a Recv SQE.
+// PrepareRecv is used to prepare a Recv SQE, flags are the MSG_* flags of
+// recv(2).
 func (r *Ring) PrepareRecv(
 	fd int,
 	b []byte,
-	flags uint8,
+	flags int,
 ) (uint64, error) {
-	sqe, ready := r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
-	}
+	return r.prepare(b, func(sqe *SubmitEntry) {
+		prepRecv(sqe, fd, b, flags)
+	})
+}
 
+// prepRecv prepares a recv of b on the fd.
+func prepRecv(sqe *SubmitEntry, fd int, b []byte, flags int) {
 	sqe.Opcode = Recv
-	sqe.UserData = r.ID()
 	sqe.Fd = int32(fd)
 	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-	return sqe.UserData, nil
+	sqe.UFlags = int32(flags)
+	if len(b) > 0 {
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
+	}
 }
 
-// Recv is used to recv data on a socket.
+// Recv is used to recv data on a socket, it returns the number of bytes
+// received. Like recv(2) zero bytes are returned once the peer has shut
+// down.
 func (r *Ring) Recv(
 	fd int,
 	b []byte,
-	flags uint8,
-) error {
-	id, err := r.PrepareRecv(fd, b, flags)
-	if err != nil {
-		return err
-	}
-	errno, _ := r.complete(id)
+	flags int,
+) (int, error) {
+	res, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepRecv(sqe, fd, b, flags)
+	})
 	// No GC until the request is done.
 	runtime.KeepAlive(b)
-	if errno < 0 {
-		return syscall.Errno(-errno)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// RecvFull is used to recv exactly len(b) bytes from a socket. Like
+// io.ReadFull it returns io.EOF if nothing was received before the peer shut
+// down and io.ErrUnexpectedEOF if only part of b was received.
+func (r *Ring) RecvFull(
+	fd int,
+	b []byte,
+	flags int,
+) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := r.Recv(fd, b[n:], flags)
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, io.ErrUnexpectedEOF
+		}
+		n += m
+	}
+	return n, nil
 }
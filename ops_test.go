@@ -3,6 +3,7 @@
 package iouring
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,8 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"syscall"
 	"testing"
@@ -28,20 +31,48 @@ func TestPrepareAccept(t *testing.T) {
 		syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
 	require.NoError(t, err)
 	require.True(t, fd > 0)
-	addr := &syscall.SockaddrInet4{
-		Port: 80,
-	}
-	copy(addr.Addr[:], net.ParseIP("8.8.8.8"))
+	var (
+		addr    syscall.RawSockaddrAny
+		socklen = uint32(syscall.SizeofSockaddrAny)
+	)
 	id, err := r.PrepareAccept(
 		fd,
-		addr,
-		syscall.SizeofSockaddrInet4,
+		&addr,
+		&socklen,
 		0,
 	)
 	require.NoError(t, err)
 	require.True(t, id > uint64(0))
 }
 
+func TestAccept(t *testing.T) {
+	r, err := New(2048, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp4", l.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	fd, sa, err := r.Accept(int(f.Fd()), syscall.SOCK_CLOEXEC)
+	require.NoError(t, err)
+	require.True(t, fd > 0)
+	require.NoError(t, syscall.Close(fd))
+	sa4, ok := sa.(*syscall.SockaddrInet4)
+	require.True(t, ok)
+	require.Equal(t, [4]byte{127, 0, 0, 1}, sa4.Addr)
+}
+
 func TestClose(t *testing.T) {
 	r, err := New(2048, nil)
 	require.NoError(t, err)
@@ -269,10 +300,20 @@ func TestPrepareReadv(t *testing.T) {
 	_, err = f.Seek(0, 0)
 	require.NoError(t, err)
 
-	v := make([]*syscall.Iovec, 1)
+	a, b := make([]byte, 7), make([]byte, 8)
+	v := make([]syscall.Iovec, 2)
+	v[0].Base, v[1].Base = &a[0], &b[0]
+	v[0].SetLen(len(a))
+	v[1].SetLen(len(b))
 	id, err := r.PrepareReadv(int(f.Fd()), v, 0)
 	require.NoError(t, err)
 	require.True(t, id > uint64(0))
+	require.NoError(t, r.submit())
+	// Nothing waits on a prepared request, so wait for the data.
+	eventually(t, func() bool {
+		return bytes.Equal(data, append(append([]byte{}, a...), b...))
+	})
+	runtime.KeepAlive(v)
 }
 
 func TestSplice(t *testing.T) {
@@ -311,10 +352,10 @@ func TestSplice(t *testing.T) {
 }
 
 func TestRingSplice(t *testing.T) {
-	t.Skip("FIX ME")
 	r, err := New(2048, nil)
 	require.NoError(t, err)
 	require.NotNil(t, r)
+	defer r.Stop()
 
 	out, err := ioutil.TempFile("", "out")
 	require.NoError(t, err)
@@ -421,10 +462,79 @@ func TestSend(t *testing.T) {
 	require.NoError(t, err)
 	f, err := c.File()
 	require.NoError(t, err)
-	require.NoError(t, r.Send(int(f.Fd()), b, 0))
+	n, err := r.Send(int(f.Fd()), b, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(b), n)
 	wg.Wait()
 }
 
+func TestRecv(t *testing.T) {
+	r, err := New(2048, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	b := []byte("some bytes")
+	n, err := r.Send(fds[0], b, syscall.MSG_NOSIGNAL)
+	require.NoError(t, err)
+	require.Equal(t, len(b), n)
+
+	// MSG_PEEK leaves the data in the socket.
+	buf := make([]byte, 64)
+	n, err = r.Recv(fds[1], buf, syscall.MSG_PEEK)
+	require.NoError(t, err)
+	require.Equal(t, b, buf[:n])
+	n, err = r.Recv(fds[1], buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, b, buf[:n])
+
+	require.NoError(t, syscall.Shutdown(fds[0], syscall.SHUT_WR))
+	n, err = r.Recv(fds[1], buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestSendAllRecvFull(t *testing.T) {
+	r, err := New(2048, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// Larger than the socket buffer so the send is short.
+	b := make([]byte, 1<<20)
+	rand.Read(b)
+	sent := make(chan error, 1)
+	go func() {
+		n, err := r.SendAll(fds[0], b, 0)
+		if err == nil && n != len(b) {
+			err = io.ErrShortWrite
+		}
+		syscall.Shutdown(fds[0], syscall.SHUT_WR)
+		sent <- err
+	}()
+
+	buf := make([]byte, len(b))
+	n, err := r.RecvFull(fds[1], buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(b), n)
+	require.Equal(t, b, buf)
+	require.NoError(t, <-sent)
+
+	n, err = r.RecvFull(fds[1], buf, 0)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 0, n)
+}
+
 func BenchmarkStatxRing(b *testing.B) {
 	r, err := New(2048, nil)
 	require.NoError(b, err)
@@ -465,6 +575,53 @@ func TestPrepareTimeout(t *testing.T) {
 	require.True(t, id > uint64(0))
 }
 
+func TestPreparePins(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// The memory of prepared requests is kept alive until they complete.
+	pinned := func(id uint64) bool {
+		r.pendMu.Lock()
+		defer r.pendMu.Unlock()
+		_, ok := r.pins[id]
+		return ok
+	}
+	ids := make([]uint64, 0, 4)
+	id, err := r.PrepareTimeout(&syscall.Timespec{Nsec: int64(time.Millisecond)}, 0, 0)
+	require.NoError(t, err)
+	ids = append(ids, id)
+	id, err = r.PrepareWrite(fds[1], []byte("hello"), 0, 0)
+	require.NoError(t, err)
+	ids = append(ids, id)
+	id, err = r.PrepareRead(fds[0], make([]byte, 8), 0, 0)
+	require.NoError(t, err)
+	ids = append(ids, id)
+	b := make([]byte, 8)
+	msg := &syscall.Msghdr{Iov: &syscall.Iovec{Base: &b[0], Len: uint64(len(b))}, Iovlen: 1}
+	id, err = r.PrepareRecvmsg(fds[0], msg, syscall.MSG_DONTWAIT)
+	require.NoError(t, err)
+	ids = append(ids, id)
+	for _, id := range ids {
+		require.True(t, pinned(id))
+	}
+
+	require.NoError(t, r.submit())
+	eventually(t, func() bool {
+		for _, id := range ids {
+			if pinned(id) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
 func TestPrepareTimeoutRemove(t *testing.T) {
 	r, err := New(2048, nil)
 	require.NoError(t, err)
@@ -484,13 +641,60 @@ func TestPrepareWritev(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	b := byte(1)
-	v := &syscall.Iovec{
-		Base: &b,
-	}
-	v.SetLen(1)
-	iovs := []*syscall.Iovec{v}
-	id, err := r.PrepareReadv(int(f.Fd()), iovs, 0)
+	a, b := []byte("hello "), []byte("world")
+	iovs := make([]syscall.Iovec, 2)
+	iovs[0].Base, iovs[1].Base = &a[0], &b[0]
+	iovs[0].SetLen(len(a))
+	iovs[1].SetLen(len(b))
+	id, err := r.PrepareWritev(int(f.Fd()), iovs, 0)
 	require.NoError(t, err)
 	require.True(t, id > uint64(0))
+	require.NoError(t, r.submit())
+	// Nothing waits on a prepared request, so wait for the data.
+	eventually(t, func() bool {
+		got, err := ioutil.ReadFile(f.Name())
+		return err == nil && string(got) == "hello world"
+	})
+	runtime.KeepAlive(iovs)
+}
+
+func TestShutdown(t *testing.T) {
+	r, err := New(2048, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	require.NoError(t, r.Shutdown(fds[0], syscall.SHUT_WR))
+	n, err := r.Recv(fds[1], make([]byte, 8), 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	require.Equal(t, syscall.EINVAL, r.Shutdown(fds[0], 42))
+}
+
+func TestRenameUnlinkAt(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "rename")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	old := filepath.Join(dir, "old")
+	require.NoError(t, ioutil.WriteFile(old, []byte("data"), 0644))
+
+	require.NoError(t, r.RenameAt(unix.AT_FDCWD, old, unix.AT_FDCWD, filepath.Join(dir, "new"), 0))
+	_, err = os.Stat(old)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, syscall.ENOENT, r.RenameAt(unix.AT_FDCWD, old, unix.AT_FDCWD, filepath.Join(dir, "new"), 0))
+
+	require.NoError(t, r.UnlinkAt(unix.AT_FDCWD, filepath.Join(dir, "new"), 0))
+	require.Equal(t, syscall.ENOENT, r.UnlinkAt(unix.AT_FDCWD, filepath.Join(dir, "new"), 0))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, r.UnlinkAt(unix.AT_FDCWD, filepath.Join(dir, "sub"), unix.AT_REMOVEDIR))
 }
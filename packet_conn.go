@@ -0,0 +1,348 @@
+// +build linux
+
+package iouring
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Message is a datagram that is used for batched reads and writes.
+type Message struct {
+	// Buf is the payload of the datagram.
+	Buf []byte
+	// Addr is the address of the peer, it is set when reading and
+	// required when writing.
+	Addr net.Addr
+	// N is the number of bytes read or written.
+	N int
+}
+
+// BatchPacketConn is a net.PacketConn that is able to read and write many
+// datagrams with a single enter of the ring.
+type BatchPacketConn interface {
+	net.PacketConn
+	// ReadBatch blocks until at least one datagram is read and then reads
+	// any other datagrams that are available without blocking. It returns
+	// the number of messages read.
+	ReadBatch(ms []Message) (int, error)
+	// WriteBatch writes the messages in order and returns the number of
+	// messages written. Only the first write blocks, the batch stops at
+	// the first message that can't be written without blocking.
+	WriteBatch(ms []Message) (int, error)
+}
+
+// msg holds everything the kernel needs for a sendmsg/recvmsg request, it
+// must not be moved or collected until the request completes.
+type msg struct {
+	hdr syscall.Msghdr
+	iov syscall.Iovec
+	rsa syscall.RawSockaddrAny
+}
+
+// newMsg returns a msg for the buffer, for writes the raw address of the peer
+// should be set with the length of the address.
+func newMsg(b []byte, rsa *syscall.RawSockaddrAny, socklen uint32) *msg {
+	m := &msg{}
+	if len(b) > 0 {
+		m.iov.Base = &b[0]
+		m.iov.SetLen(len(b))
+	}
+	m.hdr.Iov = &m.iov
+	m.hdr.Iovlen = 1
+	if rsa != nil {
+		m.rsa = *rsa
+	}
+	m.hdr.Name = (*byte)(unsafe.Pointer(&m.rsa))
+	m.hdr.Namelen = socklen
+	return m
+}
+
+// ringPacketConn is a net.PacketConn that is backed by the Ring.
+type ringPacketConn struct {
+	fd      int
+	network string
+	laddr   *net.UDPAddr
+	r       *Ring
+
+	rd ioDeadline
+	wd ioDeadline
+}
+
+// ListenPacket returns a net.PacketConn that is Ring based, reads and writes
+// use recvmsg and sendmsg requests. Known networks are "udp", "udp4" and
+// "udp6". The returned net.PacketConn also implements BatchPacketConn.
+func (r *Ring) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	netAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	family, sa, err := ipSockaddr(network, netAddr.IP, netAddr.Port, netAddr.Zone)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: netAddr, Err: err}
+	}
+	fd, err := syscall.Socket(
+		family,
+		syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC,
+		0,
+	)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: netAddr, Err: err}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: netAddr, Err: err}
+	}
+	c := &ringPacketConn{
+		fd:      fd,
+		network: network,
+		laddr:   netAddr,
+		r:       r,
+	}
+	if lsa, err := syscall.Getsockname(fd); err == nil {
+		c.laddr = sockaddrToUDPAddr(lsa)
+	}
+	return c, nil
+}
+
+// sockaddrToUDPAddr returns a *net.UDPAddr for an IP based syscall.Sockaddr.
+func sockaddrToUDPAddr(sa syscall.Sockaddr) *net.UDPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		a := &net.UDPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				a.Zone = ifi.Name
+			}
+		}
+		return a
+	}
+	return nil
+}
+
+// rawAddr returns the raw sockaddr of a peer for writing.
+func (c *ringPacketConn) rawAddr(a net.Addr) (*syscall.RawSockaddrAny, uint32, error) {
+	udpAddr, ok := a.(*net.UDPAddr)
+	if !ok {
+		if a == nil {
+			return nil, 0, syscall.EDESTADDRREQ
+		}
+		var err error
+		udpAddr, err = net.ResolveUDPAddr(c.network, a.String())
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	ip := udpAddr.IP
+	if c.laddr.IP.To4() == nil && ip.To4() != nil {
+		// IPv4 peers of an IPv6 socket use mapped addresses.
+		ip = ip.To16()
+	}
+	network := c.network
+	if c.laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	_, sa, err := ipSockaddr(network, ip, udpAddr.Port, udpAddr.Zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rawSockaddr(sa)
+}
+
+// ReadFrom implements the net.PacketConn interface.
+func (c *ringPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	m := newMsg(b, nil, syscall.SizeofSockaddrAny)
+	res, err := c.rd.do(c.r, func(sqe *SubmitEntry) {
+		sqe.Opcode = RecvMsg
+		sqe.Fd = int32(c.fd)
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&m.hdr)))
+		sqe.Len = 1
+	})
+	runtime.KeepAlive(b)
+	runtime.KeepAlive(m)
+	if err != nil {
+		return 0, nil, c.opError("read", nil, err)
+	}
+	if res < 0 {
+		return 0, nil, c.opError("read", nil, syscall.Errno(-res))
+	}
+	sa, err := anyToSockaddr(&m.rsa, m.hdr.Namelen)
+	if err != nil {
+		return int(res), nil, c.opError("read", nil, err)
+	}
+	return int(res), sockaddrToUDPAddr(sa), nil
+}
+
+// WriteTo implements the net.PacketConn interface.
+func (c *ringPacketConn) WriteTo(b []byte, a net.Addr) (int, error) {
+	rsa, socklen, err := c.rawAddr(a)
+	if err != nil {
+		return 0, c.opError("write", a, err)
+	}
+	m := newMsg(b, rsa, socklen)
+	res, err := c.wd.do(c.r, func(sqe *SubmitEntry) {
+		sqe.Opcode = SendMsg
+		sqe.Fd = int32(c.fd)
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&m.hdr)))
+		sqe.Len = 1
+	})
+	runtime.KeepAlive(b)
+	runtime.KeepAlive(m)
+	if err != nil {
+		return 0, c.opError("write", a, err)
+	}
+	if res < 0 {
+		return 0, c.opError("write", a, syscall.Errno(-res))
+	}
+	return int(res), nil
+}
+
+// batch is used to submit a chain of linked sendmsg/recvmsg requests with a
+// single enter and returns the results of the requests. The deadline of d
+// applies to the first request.
+func (c *ringPacketConn) batch(d *ioDeadline, op Opcode, ms []*msg, flags []int) ([]int32, error) {
+	preps := make([]func(*SubmitEntry), len(ms))
+	for i := range ms {
+		m, f := ms[i], flags[i]
+		preps[i] = func(sqe *SubmitEntry) {
+			sqe.Opcode = op
+			sqe.Fd = int32(c.fd)
+			sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&m.hdr)))
+			sqe.Len = 1
+			sqe.UFlags = int32(f)
+		}
+	}
+	res, err := d.chain(c.r, preps...)
+	runtime.KeepAlive(ms)
+	return res, err
+}
+
+// maxBatch returns the number of messages that fit into a single batch,
+// which leaves room for the timeout of the deadline.
+func (c *ringPacketConn) maxBatch(n int) int {
+	if max := int(c.r.p.SqEntries) - 1; n > max {
+		return max
+	}
+	return n
+}
+
+// ReadBatch implements the BatchPacketConn interface.
+func (c *ringPacketConn) ReadBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	ms = ms[:c.maxBatch(len(ms))]
+	msgs := make([]*msg, len(ms))
+	flags := make([]int, len(ms))
+	for i := range ms {
+		msgs[i] = newMsg(ms[i].Buf, nil, syscall.SizeofSockaddrAny)
+		if i > 0 {
+			// Only the first read blocks, the chain breaks on
+			// the first read without a datagram.
+			flags[i] = syscall.MSG_DONTWAIT
+		}
+	}
+	res, err := c.batch(&c.rd, RecvMsg, msgs, flags)
+	if err != nil {
+		return 0, c.opError("read", nil, err)
+	}
+	for i, n := range res {
+		if n < 0 {
+			if i == 0 {
+				return 0, c.opError("read", nil, syscall.Errno(-n))
+			}
+			return i, nil
+		}
+		ms[i].N = int(n)
+		ms[i].Addr = nil
+		if sa, err := anyToSockaddr(&msgs[i].rsa, msgs[i].hdr.Namelen); err == nil {
+			ms[i].Addr = sockaddrToUDPAddr(sa)
+		}
+	}
+	return len(res), nil
+}
+
+// WriteBatch implements the BatchPacketConn interface.
+func (c *ringPacketConn) WriteBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	ms = ms[:c.maxBatch(len(ms))]
+	msgs := make([]*msg, len(ms))
+	flags := make([]int, len(ms))
+	for i := range ms {
+		rsa, socklen, err := c.rawAddr(ms[i].Addr)
+		if err != nil {
+			return 0, c.opError("write", ms[i].Addr, err)
+		}
+		msgs[i] = newMsg(ms[i].Buf, rsa, socklen)
+		if i > 0 {
+			// Only the first write blocks, the chain breaks on
+			// the first write that would block.
+			flags[i] = syscall.MSG_DONTWAIT
+		}
+	}
+	res, err := c.batch(&c.wd, SendMsg, msgs, flags)
+	if err != nil {
+		return 0, c.opError("write", nil, err)
+	}
+	for i, n := range res {
+		if n < 0 {
+			if i > 0 && (n == -int32(syscall.EAGAIN) || n == -int32(syscall.ECANCELED)) {
+				return i, nil
+			}
+			return i, c.opError("write", ms[i].Addr, syscall.Errno(-n))
+		}
+		ms[i].N = int(n)
+	}
+	return len(res), nil
+}
+
+func (c *ringPacketConn) opError(op string, a net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: c.network, Source: c.laddr, Addr: a, Err: err}
+}
+
+// Close implements the net.PacketConn interface.
+func (c *ringPacketConn) Close() error {
+	if !c.rd.close(c.r) {
+		return c.opError("close", nil, errClosed)
+	}
+	// Pending requests are canceled before the fd is closed so that the
+	// fd can't be reused while they are still in flight.
+	c.wd.close(c.r)
+	return syscall.Close(c.fd)
+}
+
+// LocalAddr implements the net.PacketConn interface.
+func (c *ringPacketConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// SetDeadline implements the net.PacketConn interface.
+func (c *ringPacketConn) SetDeadline(t time.Time) error {
+	c.rd.set(c.r, t)
+	c.wd.set(c.r, t)
+	return nil
+}
+
+// SetReadDeadline implements the net.PacketConn interface.
+func (c *ringPacketConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(c.r, t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.PacketConn interface.
+func (c *ringPacketConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(c.r, t)
+	return nil
+}
@@ -0,0 +1,205 @@
+// +build linux
+
+package iouring
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenPacket(t *testing.T) {
+	tests := []struct {
+		network string
+		address string
+	}{
+		{network: "udp", address: "127.0.0.1:0"},
+		{network: "udp4", address: "127.0.0.1:0"},
+		{network: "udp6", address: "[::1]:0"},
+	}
+	for _, test := range tests {
+		t.Run(test.network, func(t *testing.T) {
+			r, err := New(1024, nil)
+			require.NoError(t, err)
+			require.NotNil(t, r)
+			defer r.Stop()
+
+			c, err := r.ListenPacket(test.network, test.address)
+			if err != nil && test.network == "udp6" {
+				t.Skipf("ipv6 unavailable: %v", err)
+			}
+			require.NoError(t, err)
+			defer c.Close()
+
+			peer, err := net.ListenPacket(test.network, test.address)
+			require.NoError(t, err)
+			defer peer.Close()
+
+			data := []byte("hello udp")
+			n, err := c.WriteTo(data, peer.LocalAddr())
+			require.NoError(t, err)
+			require.Equal(t, len(data), n)
+
+			buf := make([]byte, 64)
+			require.NoError(t, peer.SetReadDeadline(time.Now().Add(5*time.Second)))
+			n, from, err := peer.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, data, buf[:n])
+			require.Equal(t, c.LocalAddr().String(), from.String())
+
+			_, err = peer.WriteTo([]byte("reply"), c.LocalAddr())
+			require.NoError(t, err)
+			n, from, err = c.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, "reply", string(buf[:n]))
+			require.Equal(t, peer.LocalAddr().String(), from.String())
+		})
+	}
+}
+
+func TestListenPacketUnknownNetwork(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	_, err = r.ListenPacket("tcp", "127.0.0.1:0")
+	require.Error(t, err)
+
+	_, err = r.SockoptListener("udp", "127.0.0.1:0", nil)
+	require.Error(t, err)
+}
+
+func TestPacketConnBatch(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	pc, err := r.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	c := pc.(BatchPacketConn)
+
+	peer, err := r.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	const nMsgs = 16
+	out := make([]Message, nMsgs)
+	for i := range out {
+		out[i] = Message{
+			Buf:  []byte(fmt.Sprintf("datagram-%d", i)),
+			Addr: peer.LocalAddr(),
+		}
+	}
+	n, err := c.WriteBatch(out)
+	require.NoError(t, err)
+	require.Equal(t, nMsgs, n)
+	for _, m := range out {
+		require.Equal(t, len(m.Buf), m.N)
+	}
+
+	in := make([]Message, nMsgs)
+	for i := range in {
+		in[i].Buf = make([]byte, 64)
+	}
+	// Loopback datagrams are queued by the time the writes complete, so
+	// they are all read with a single batch.
+	n, err = peer.(BatchPacketConn).ReadBatch(in)
+	require.NoError(t, err)
+	require.Equal(t, nMsgs, n)
+	for i, m := range in {
+		require.Equal(t, fmt.Sprintf("datagram-%d", i), string(m.Buf[:m.N]))
+		require.Equal(t, c.LocalAddr().String(), m.Addr.String())
+	}
+}
+
+func TestPacketConnReadDeadline(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	c, err := r.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, err = c.ReadFrom(make([]byte, 8))
+	require.Error(t, err)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, nerr.Timeout())
+}
+
+func TestPacketConnBatchDeadline(t *testing.T) {
+	// A ring with fewer entries than messages.
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	pc, err := r.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	c := pc.(BatchPacketConn)
+
+	in := make([]Message, 16)
+	for i := range in {
+		in[i].Buf = make([]byte, 64)
+	}
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, err = c.ReadBatch(in)
+	require.Error(t, err)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, nerr.Timeout())
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// The rest of the chain still runs once the first read completes.
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	peer, err := r.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+	for i := 0; i < 3; i++ {
+		_, err := peer.WriteTo([]byte("x"), c.LocalAddr())
+		require.NoError(t, err)
+	}
+	n, err := c.ReadBatch(in)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+}
+
+func TestPacketConnBatchClose(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	pc, err := r.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	c := pc.(BatchPacketConn)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.ReadBatch(make([]Message, 4))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, pc.Close())
+	select {
+	case err := <-errc:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ReadBatch was not canceled by Close")
+	}
+	_, err = c.WriteBatch([]Message{{Buf: []byte("x"), Addr: pc.LocalAddr()}})
+	require.Error(t, err)
+
+	// The size of a batch doesn't depend on the SQ being mapped.
+	require.NoError(t, r.Stop())
+	_, err = c.ReadBatch(make([]Message, 4))
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+// +build linux
+
+package iouring
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawConn is a syscall.RawConn for ring based sockets, waiting for the socket
+// to be ready is done with poll requests on the ring. The polls are canceled
+// once the connection is closed and use the deadlines of the connection.
+type rawConn struct {
+	r  *Ring
+	fd int
+	rd *ioDeadline
+	wd *ioDeadline
+}
+
+func (c *rawConn) closed() bool {
+	c.rd.mu.Lock()
+	defer c.rd.mu.Unlock()
+	return c.rd.closed
+}
+
+// Control implements the syscall.RawConn interface.
+func (c *rawConn) Control(f func(fd uintptr)) error {
+	if c.closed() {
+		return errClosed
+	}
+	f(uintptr(c.fd))
+	return nil
+}
+
+// Read implements the syscall.RawConn interface.
+func (c *rawConn) Read(f func(fd uintptr) bool) error {
+	return c.wait(c.rd, POLLIN, f)
+}
+
+// Write implements the syscall.RawConn interface.
+func (c *rawConn) Write(f func(fd uintptr) bool) error {
+	return c.wait(c.wd, POLLOUT, f)
+}
+
+// wait calls f until it returns true, the socket is polled for the events in
+// mask whenever f returns false.
+func (c *rawConn) wait(d *ioDeadline, mask int, f func(fd uintptr) bool) error {
+	for {
+		if c.closed() {
+			return errClosed
+		}
+		if f(uintptr(c.fd)) {
+			return nil
+		}
+		res, err := d.do(c.r, func(sqe *SubmitEntry) {
+			sqe.Opcode = PollAdd
+			sqe.Fd = int32(c.fd)
+			sqe.UFlags = int32(mask)
+		})
+		if err != nil {
+			return err
+		}
+		if res < 0 {
+			return syscall.Errno(-res)
+		}
+	}
+}
+
+// dupFile returns a duplicate of the fd as an os.File, closing the file does
+// not affect the fd.
+func dupFile(fd int, name string) (*os.File, error) {
+	nfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+	return os.NewFile(uintptr(nfd), name), nil
+}
@@ -11,6 +11,7 @@ import (
 	"unsafe"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 // ReadWriteAtCloser supports reading, writing, and closing.
@@ -19,218 +20,303 @@ type ReadWriteAtCloser interface {
 	io.ReadWriteCloser
 }
 
-// ringFIO is used for handling file IO.
+var (
+	errNegativeOffset = errors.New("negative offset")
+
+	// errWriteAtInAppendMode is the error os.File returns for a WriteAt on a
+	// file opened with O_APPEND.
+	errWriteAtInAppendMode = errors.New("os: invalid use of WriteAt on file opened with O_APPEND")
+)
+
+// ringFIO is used for handling file IO. Reads and writes are positional,
+// the offset of the file is tracked in fOffset and follows the semantics of
+// an os.File.
 type ringFIO struct {
-	r       *Ring
+	r *Ring
+	// f is the os.File the fd belongs to, it is nil for a File.
 	f       *os.File
+	name    string
 	fd      int32
 	fOffset *int64
-	c       *completer
+	// append is set when the file was opened with O_APPEND.
+	append bool
+	// direct is set when the file was opened with O_DIRECT, the buffers
+	// and offsets must then be aligned, see AlignedBuffers.
+	direct bool
 }
 
-// getCqe is used for getting a CQE result and will retry up to one time.
-func (i *ringFIO) getCqe(reqID uint64, count, min int) (int, error) {
-	// TODO: consider adding the submitter interface here, or move out the
-	// submit function from this method all together.
-	if count > 0 || min > 0 {
-		_, err := i.r.Enter(uint(count), uint(min), EnterGetEvents, nil)
-		if err != nil {
-			return 0, err
-		}
+// getCqe is used for submitting a request and getting its CQE result.
+func (i *ringFIO) getCqe(prep func(*SubmitEntry)) (int, error) {
+	res, _, err := i.r.complete(prep)
+	if err != nil {
+		return 0, err
+	}
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// pathError wraps an error like the errors of an os.File.
+func (i *ringFIO) pathError(op string, err error) error {
+	return &os.PathError{Op: op, Path: i.name, Err: err}
+}
+
+// reserve atomically reserves n bytes at the file offset and returns the
+// offset of the reservation, concurrent reads and writes use different
+// parts of the file.
+func (i *ringFIO) reserve(n int) int64 {
+	return atomic.AddInt64(i.fOffset, int64(n)) - int64(n)
+}
+
+// unreserve moves the file offset back to the end of the used part of a
+// reservation of n bytes at off, unless the offset was changed since.
+func (i *ringFIO) unreserve(off int64, n, used int) {
+	if used < n {
+		atomic.CompareAndSwapInt64(i.fOffset, off+int64(n), off+int64(used))
 	}
+}
 
-	cq := i.r.cq
-	foundIdx := 0
-findCqe:
-	head := atomic.LoadUint32(cq.Head)
-	tail := atomic.LoadUint32(cq.Tail)
-	mask := atomic.LoadUint32(cq.Mask)
-	end := int(tail & mask)
+// prepare is used to prepare a read or write SQE at the offset.
+func (i *ringFIO) prepare(op Opcode, b []byte, offset int64, flags uint8) (uint64, func(), error) {
+	sqe, ready := i.r.SubmitEntry()
+	if sqe == nil {
+		return 0, nil, errRingUnavailable
+	}
+	i.prepRW(op, b, offset, flags)(sqe)
+	sqe.UserData = i.r.ID()
+	i.r.pin(sqe.UserData, b)
+	return sqe.UserData, ready, nil
+}
 
-	for x := int(head & mask); x < len(cq.Entries); x++ {
-		cqe := cq.Entries[x]
-		if cqe.UserData == reqID {
-			if cqe.Res < 0 {
-				return 0, syscall.Errno(-cqe.Res)
+// prepRW returns a function that prepares a read or write SQE of b at the
+// offset.
+func (i *ringFIO) prepRW(op Opcode, b []byte, offset int64, flags uint8) func(*SubmitEntry) {
+	return func(sqe *SubmitEntry) {
+		sqe.Opcode = op
+		sqe.Fd = i.fd
+		sqe.Len = uint32(len(b))
+		sqe.Flags = flags
+		sqe.Offset = uint64(offset)
+		if len(b) > 0 {
+			sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
+		}
+		// Buffers that are registered with the ring don't need to be
+		// mapped by the kernel for every request.
+		if idx, ok := i.r.fixedIndex(b); ok {
+			switch op {
+			case Read:
+				sqe.Opcode = ReadFixed
+				setBufIndex(sqe, idx)
+			case Write:
+				sqe.Opcode = WriteFixed
+				setBufIndex(sqe, idx)
 			}
-			atomic.StoreInt64(i.fOffset, atomic.LoadInt64(i.fOffset)+int64(cqe.Res))
-			foundIdx = x
-			i.c.complete(foundIdx)
-			return int(cqe.Res), nil
 		}
-		if x == end {
-			goto findCqe
+	}
+}
+
+// rw does a single read or write of b at the offset, interrupted requests
+// are retried.
+func (i *ringFIO) rw(op Opcode, b []byte, offset int64) (int, error) {
+	for {
+		n, err := i.getCqe(i.prepRW(op, b, offset, 0))
+		runtime.KeepAlive(b)
+		if err == syscall.EINTR {
+			continue
 		}
+		return n, err
 	}
-	tail = atomic.LoadUint32(cq.Tail)
-	mask = atomic.LoadUint32(cq.Mask)
-	end = int(tail & mask)
-	for x := 0; x < end; x++ {
-		cqe := cq.Entries[x]
-		if cqe.UserData == reqID {
-			if cqe.Res < 0 {
-				return 0, syscall.Errno(-cqe.Res)
-			}
-			atomic.StoreInt64(i.fOffset, atomic.LoadInt64(i.fOffset)+int64(cqe.Res))
-			foundIdx = x
-			i.c.complete(foundIdx)
-			return int(cqe.Res), nil
+}
+
+// writeAll writes all of b at the offset.
+func (i *ringFIO) writeAll(b []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := i.rw(Write, b[n:], offset+int64(n))
+		if err != nil {
+			return n, err
 		}
-		if x == end {
-			goto findCqe
+		if m == 0 {
+			return n, io.ErrShortWrite
 		}
+		n += m
 	}
-	goto findCqe
+	return n, nil
 }
 
-// Write implements the io.Writer interface.
+// Write implements the io.Writer interface, the file offset is advanced by
+// the number of bytes written. Files opened with O_APPEND are written at the
+// end of the file.
 func (i *ringFIO) Write(b []byte) (int, error) {
-	id, ready, err := i.PrepareWrite(b, 0)
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if i.append {
+		// The kernel ignores the offset when appending.
+		n, err := i.writeAll(b, 0)
+		if end, serr := unix.Seek(int(i.fd), 0, io.SeekEnd); serr == nil {
+			atomic.StoreInt64(i.fOffset, end)
+		}
+		if err != nil {
+			return n, i.pathError("write", err)
+		}
+		return n, nil
+	}
+	off := i.reserve(len(b))
+	n, err := i.writeAll(b, off)
+	i.unreserve(off, len(b), n)
 	if err != nil {
-		return 0, err
+		return n, i.pathError("write", err)
 	}
-	ready()
-	n, err := i.getCqe(id, 1, 1)
-	runtime.KeepAlive(b)
-	return n, err
+	return n, nil
 }
 
-// PrepareWrite is used to prepare a Write SQE. The ring is able to be entered
-// after the returned callback is called.
+// PrepareWrite is used to prepare a Write SQE at the file offset, the offset
+// is not advanced. The ring is able to be entered after the returned
+// callback is called.
 func (i *ringFIO) PrepareWrite(b []byte, flags uint8) (uint64, func(), error) {
-	sqe, ready := i.r.SubmitEntry()
-	if sqe == nil {
-		return 0, nil, errRingUnavailable
-	}
-
-	sqe.Opcode = Write
-	sqe.UserData = i.r.ID()
-	sqe.Fd = i.fd
-	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Offset = uint64(atomic.LoadInt64(i.fOffset))
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	return sqe.UserData, ready, nil
+	return i.prepare(Write, b, atomic.LoadInt64(i.fOffset), flags)
 }
 
-// PrepareRead is used to prepare a Read SQE. The ring is able to be entered
-// after the returned callback is called.
+// PrepareRead is used to prepare a Read SQE at the file offset, the offset is
+// not advanced. The ring is able to be entered after the returned callback
+// is called.
 func (i *ringFIO) PrepareRead(b []byte, flags uint8) (uint64, func(), error) {
-	sqe, ready := i.r.SubmitEntry()
-	if sqe == nil {
-		return 0, nil, errRingUnavailable
-	}
-
-	sqe.Opcode = Read
-	sqe.UserData = i.r.ID()
-	sqe.Fd = i.fd
-	sqe.Len = uint32(len(b))
-	sqe.Flags = flags
-	sqe.Offset = uint64(atomic.LoadInt64(i.fOffset))
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	return sqe.UserData, ready, nil
+	return i.prepare(Read, b, atomic.LoadInt64(i.fOffset), flags)
 }
 
-// Read implements the io.Reader interface.
+// Read implements the io.Reader interface, the file offset is advanced by
+// the number of bytes read.
 func (i *ringFIO) Read(b []byte) (int, error) {
-	id, ready, err := i.PrepareRead(b, 0)
-	if err != nil {
-		return 0, err
+	if len(b) == 0 {
+		return 0, nil
 	}
-	ready()
-	n, err := i.getCqe(id, 1, 1)
-	runtime.KeepAlive(b)
+	off := i.reserve(len(b))
+	n, err := i.rw(Read, b, off)
+	i.unreserve(off, len(b), n)
 	if err != nil {
-		return 0, err
+		return 0, i.pathError("read", err)
 	}
 	if n == 0 {
-		return n, io.EOF
+		return 0, io.EOF
 	}
 	return n, nil
 }
 
-// WriteAt implements the io.WriterAt interface.
+// WriteAt implements the io.WriterAt interface, the file offset is not
+// changed.
 func (i *ringFIO) WriteAt(b []byte, o int64) (int, error) {
-	sqe, ready := i.r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
+	if i.append {
+		return 0, errWriteAtInAppendMode
 	}
-
-	sqe.Opcode = Write
-	sqe.UserData = i.r.ID()
-	sqe.Fd = i.fd
-	sqe.Len = uint32(len(b))
-	sqe.Flags = 0
-	sqe.Offset = uint64(o)
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-
-	n, err := i.getCqe(sqe.UserData, 1, 1)
-	runtime.KeepAlive(b)
-	return n, err
+	if o < 0 {
+		return 0, i.pathError("writeat", errNegativeOffset)
+	}
+	n, err := i.writeAll(b, o)
+	if err != nil {
+		return n, i.pathError("write", err)
+	}
+	return n, nil
 }
 
-// ReadAt implements the io.ReaderAt interface.
+// ReadAt implements the io.ReaderAt interface, the file offset is not
+// changed. Like os.File it reads until b is full and returns io.EOF if the
+// end of the file is reached first.
 func (i *ringFIO) ReadAt(b []byte, o int64) (int, error) {
-	sqe, ready := i.r.SubmitEntry()
-	if sqe == nil {
-		return 0, errRingUnavailable
+	if o < 0 {
+		return 0, i.pathError("readat", errNegativeOffset)
 	}
+	n := 0
+	for n < len(b) {
+		m, err := i.rw(Read, b[n:], o+int64(n))
+		if err != nil {
+			return n, i.pathError("read", err)
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		n += m
+		// Direct reads are only short at the end of the file and reading
+		// on from an unaligned offset would fail.
+		if i.direct && n < len(b) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
 
-	sqe.Opcode = Read
-	sqe.UserData = i.r.ID()
-	sqe.Fd = i.fd
-	sqe.Len = uint32(len(b))
-	sqe.Flags = 0
-	sqe.Offset = uint64(o)
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-
-	ready()
-
-	n, err := i.getCqe(sqe.UserData, 1, 1)
-	runtime.KeepAlive(b)
-	if err != nil {
-		return 0, err
+// ReadFrom implements the io.ReaderFrom interface, data is spliced from src
+// when possible.
+func (i *ringFIO) ReadFrom(src io.Reader) (int64, error) {
+	n, ok, err := i.r.spliceFrom(spliceEnd{fd: int(i.fd), off: i.fOffset}, src)
+	if !ok {
+		var m int64
+		m, err = genericReadFrom(i, src)
+		n += m
 	}
-	if n == 0 {
-		return n, io.EOF
+	return n, err
+}
+
+// WriteTo implements the io.WriterTo interface, data is spliced to dst when
+// possible.
+func (i *ringFIO) WriteTo(dst io.Writer) (int64, error) {
+	n, ok, err := i.r.spliceTo(dst, spliceEnd{fd: int(i.fd), off: i.fOffset})
+	if !ok {
+		var m int64
+		m, err = genericWriteTo(i, dst)
+		n += m
 	}
-	return n, nil
+	return n, err
 }
 
 // Close implements the io.Closer interface.
 func (i *ringFIO) Close() error {
-	id, err := i.r.PrepareClose(int(i.fd))
-	if err != nil {
-		return err
-	}
-	_, err = i.getCqe(id, 1, 1)
+	_, err := i.getCqe(func(sqe *SubmitEntry) {
+		prepClose(sqe, int(i.fd))
+	})
 	if err != nil {
-		return err
+		return i.pathError("close", err)
 	}
 	return nil
 }
 
-// Seek implements the io.Seeker interface.
+// Seek implements the io.Seeker interface, it returns the new offset. Like
+// os.File the SEEK_DATA and SEEK_HOLE whences are supported.
 func (i *ringFIO) Seek(offset int64, whence int) (int64, error) {
-	switch whence {
-	case io.SeekStart:
-		atomic.StoreInt64(i.fOffset, offset)
-		return 0, nil
-	case io.SeekCurrent:
-		atomic.StoreInt64(i.fOffset, atomic.LoadInt64(i.fOffset)+offset)
-		return 0, nil
-	case io.SeekEnd:
-		stat, err := i.f.Stat()
-		if err != nil {
-			return 0, err
+	for {
+		var base int64
+		cur := atomic.LoadInt64(i.fOffset)
+		switch whence {
+		case io.SeekStart:
+		case io.SeekCurrent:
+			base = cur
+		case io.SeekEnd:
+			var stat unix.Statx_t
+			err := i.r.fstatx(int(i.fd), unix.STATX_SIZE, &stat)
+			if err != nil {
+				return 0, i.pathError("seek", err)
+			}
+			base = int64(stat.Size)
+		case unix.SEEK_DATA, unix.SEEK_HOLE:
+			// The kernel finds the data or hole, which doesn't depend
+			// on the offset of the file.
+			next, err := unix.Seek(int(i.fd), offset, whence)
+			if err != nil {
+				return 0, i.pathError("seek", err)
+			}
+			atomic.StoreInt64(i.fOffset, next)
+			return next, nil
+		default:
+			return 0, i.pathError("seek", syscall.EINVAL)
+		}
+		next := base + offset
+		if next < 0 {
+			return 0, i.pathError("seek", syscall.EINVAL)
+		}
+		// Retry if a concurrent read or write moved the offset.
+		if atomic.CompareAndSwapInt64(i.fOffset, cur, next) {
+			return next, nil
 		}
-		atomic.StoreInt64(i.fOffset, stat.Size()-offset)
-		return 0, nil
-	default:
-		return 0, errors.New("unknown whence")
 	}
 }
@@ -3,8 +3,13 @@
 package iouring
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -62,3 +67,210 @@ func TestReadWriterWriteAt(t *testing.T) {
 		len(content),
 	)
 }
+
+// fioOp is an operation that is done on both an os.File and a ringFIO.
+type fioOp struct {
+	name   string
+	off    int64
+	whence int
+	b      []byte
+}
+
+func (op fioOp) String() string {
+	return fmt.Sprintf("%s(len=%d, off=%d, whence=%d)", op.name, len(op.b), op.off, op.whence)
+}
+
+// randFIOOp returns a random operation, the offsets are sometimes negative
+// or past the end of the file.
+func randFIOOp(rnd *rand.Rand) fioOp {
+	b := make([]byte, rnd.Intn(300))
+	rnd.Read(b)
+	off := int64(rnd.Intn(1200) - 100)
+	switch rnd.Intn(6) {
+	case 0:
+		return fioOp{name: "Read", b: b}
+	case 1:
+		return fioOp{name: "Write", b: b}
+	case 2:
+		return fioOp{name: "ReadAt", b: b, off: off}
+	case 3:
+		return fioOp{name: "WriteAt", b: b, off: off}
+	case 4:
+		return fioOp{name: "Seek", off: off, whence: rnd.Intn(6)}
+	}
+	return fioOp{name: "Seek", off: 0, whence: io.SeekCurrent}
+}
+
+type fioResult struct {
+	n   int64
+	b   []byte
+	err error
+}
+
+func applyFIOOp(f ReadWriteSeekerCloser, op fioOp) fioResult {
+	var (
+		n   int
+		n64 int64
+		err error
+		b   = append([]byte(nil), op.b...)
+	)
+	switch op.name {
+	case "Read":
+		n, err = f.Read(b)
+	case "Write":
+		n, err = f.Write(b)
+	case "ReadAt":
+		n, err = f.ReadAt(b, op.off)
+	case "WriteAt":
+		n, err = f.WriteAt(b, op.off)
+	case "Seek":
+		n64, err = f.Seek(op.off, op.whence)
+		return fioResult{n: n64, err: err}
+	}
+	return fioResult{n: int64(n), b: b[:n], err: err}
+}
+
+// requireSameErr requires the errors of an os.File and a ringFIO to match.
+func requireSameErr(t *testing.T, want, got error, msg string) {
+	if want == nil || got == nil || want == io.EOF || got == io.EOF {
+		require.Equal(t, want, got, msg)
+		return
+	}
+	wantPath, ok := want.(*os.PathError)
+	require.True(t, ok, msg)
+	gotPath, ok := got.(*os.PathError)
+	require.True(t, ok, "%s: %v", msg, got)
+	require.Equal(t, wantPath.Op, gotPath.Op, msg)
+	require.Equal(t, wantPath.Err.Error(), gotPath.Err.Error(), msg)
+}
+
+// TestReadWriterMatchesFile runs random sequences of operations on an
+// os.File and a ringFIO and requires the same results.
+func TestReadWriterMatchesFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	for seed := int64(0); seed < 50; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		want, err := ioutil.TempFile("", "fio")
+		require.NoError(t, err)
+		f, err := ioutil.TempFile("", "fio")
+		require.NoError(t, err)
+		got, err := r.FileReadWriter(f)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			op := randFIOOp(rnd)
+			msg := fmt.Sprintf("seed %d op %d: %v", seed, i, op)
+			wantRes := applyFIOOp(want, op)
+			gotRes := applyFIOOp(got, op)
+			require.Equal(t, wantRes.n, gotRes.n, msg)
+			require.Equal(t, wantRes.b, gotRes.b, msg)
+			requireSameErr(t, wantRes.err, gotRes.err, msg)
+		}
+		wantOff, err := want.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+		gotOff, err := got.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+		require.Equal(t, wantOff, gotOff)
+
+		wantData, err := ioutil.ReadFile(want.Name())
+		require.NoError(t, err)
+		gotData, err := ioutil.ReadFile(f.Name())
+		require.NoError(t, err)
+		require.Equal(t, wantData, gotData, "seed %d", seed)
+
+		want.Close()
+		f.Close()
+		os.Remove(want.Name())
+		os.Remove(f.Name())
+	}
+}
+
+func TestReadWriterAppend(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, err := ioutil.TempFile("", "fio")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	af, err := os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0)
+	require.NoError(t, err)
+	defer af.Close()
+	rw, err := r.FileReadWriter(af)
+	require.NoError(t, err)
+
+	_, err = rw.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	n, err := rw.Write([]byte(" world"))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	off, err := rw.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(11), off)
+
+	_, err = rw.WriteAt([]byte("x"), 0)
+	require.Equal(t, errWriteAtInAppendMode, err)
+
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+}
+
+// TestReadWriterConcurrentWrites checks that concurrent writes reserve
+// different parts of the file.
+func TestReadWriterConcurrentWrites(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, err := ioutil.TempFile("", "fio")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	rw, err := r.FileReadWriter(f)
+	require.NoError(t, err)
+
+	const (
+		writers = 8
+		writes  = 50
+		size    = 512
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			b := bytes.Repeat([]byte{byte(w + 1)}, size)
+			for i := 0; i < writes; i++ {
+				if _, err := rw.Write(b); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	off, err := rw.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(writers*writes*size), off)
+	data, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Len(t, data, writers*writes*size)
+	counts := make(map[byte]int)
+	for i := 0; i < len(data); i += size {
+		block := data[i : i+size]
+		require.Equal(t, bytes.Repeat(block[:1], size), block, "writes overlap at %d", i)
+		counts[block[0]]++
+	}
+	for w := 0; w < writers; w++ {
+		require.Equal(t, writes, counts[byte(w+1)])
+	}
+}
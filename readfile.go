@@ -0,0 +1,368 @@
+// +build linux
+
+package iouring
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// readFileMin is the smallest buffer used by ReadFile, like os.ReadFile
+	// files that report a size of zero, such as in /proc, are still read.
+	readFileMin = 512
+	// maxRW is the most that is read or written by a single request.
+	maxRW = 1 << 30
+)
+
+// readFile is the state of a file that is read by ReadFiles.
+type readFile struct {
+	name string
+	path *byte
+	fd   int
+	stat unix.Statx_t
+	data []byte
+	err  error
+	done bool
+}
+
+// ReadFile reads the named file with ring requests and returns its contents
+// like os.ReadFile, a successful read returns a nil error rather than io.EOF.
+func (r *Ring) ReadFile(name string) ([]byte, error) {
+	data, errs := r.ReadFiles([]string{name})
+	return data[0], errs[0]
+}
+
+// ReadFiles reads many files like ReadFile. The opens, reads and closes of
+// the files are each submitted as a batch of up to half the size of the SQ
+// at a time. The contents and errors are in the same order as the names.
+func (r *Ring) ReadFiles(names []string) ([][]byte, []error) {
+	data := make([][]byte, len(names))
+	errs := make([]error, len(names))
+	// Opening a file takes two entries.
+	window := int(r.p.SqEntries) / 2
+	if window == 0 {
+		window = 1
+	}
+	for start := 0; start < len(names); start += window {
+		end := start + window
+		if end > len(names) {
+			end = len(names)
+		}
+		r.readFiles(names[start:end], data[start:end], errs[start:end])
+	}
+	return data, errs
+}
+
+// readFiles reads the files of a window of ReadFiles.
+func (r *Ring) readFiles(names []string, data [][]byte, errs []error) {
+	files := make([]*readFile, 0, len(names))
+	for i, name := range names {
+		p, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			errs[i] = &os.PathError{Op: "open", Path: name, Err: err}
+			continue
+		}
+		files = append(files, &readFile{name: name, path: p, fd: -1})
+	}
+	r.openFiles(files)
+	r.readAll(files)
+	r.closeFiles(files)
+	runtime.KeepAlive(files)
+
+	j := 0
+	for i := range names {
+		if errs[i] != nil {
+			continue
+		}
+		f := files[j]
+		j++
+		data[i], errs[i] = f.data, f.err
+	}
+}
+
+// openFiles opens the files and stats them to size their buffers, the stat
+// is done by path so that it doesn't wait for the open.
+func (r *Ring) openFiles(files []*readFile) {
+	if len(files) == 0 {
+		return
+	}
+	preps := make([]func(*SubmitEntry), 0, len(files)*2)
+	for _, f := range files {
+		f := f
+		preps = append(preps,
+			func(sqe *SubmitEntry) {
+				prepOpenAt(sqe, unix.AT_FDCWD, f.path, os.O_RDONLY|syscall.O_CLOEXEC, 0)
+			},
+			func(sqe *SubmitEntry) {
+				prepStatx(sqe, unix.AT_FDCWD, f.path, 0, unix.STATX_SIZE, &f.stat)
+			},
+		)
+	}
+	res, err := r.batch(preps...)
+	for i, f := range files {
+		if err != nil {
+			f.err, f.done = &os.PathError{Op: "open", Path: f.name, Err: err}, true
+			continue
+		}
+		if res[2*i] < 0 {
+			f.err, f.done = &os.PathError{Op: "open", Path: f.name, Err: syscall.Errno(-res[2*i])}, true
+			continue
+		}
+		f.fd = int(res[2*i])
+		size := 0
+		if res[2*i+1] == 0 && f.stat.Size < maxRW {
+			size = int(f.stat.Size)
+		}
+		// One more byte for the read that finds the end of the file.
+		size++
+		if size < readFileMin {
+			size = readFileMin
+		}
+		f.data = make([]byte, 0, size)
+	}
+}
+
+// readAll reads the files until the end, the reads of all the files that
+// aren't done are submitted together.
+func (r *Ring) readAll(files []*readFile) {
+	for {
+		var (
+			preps   []func(*SubmitEntry)
+			pending []*readFile
+		)
+		for _, f := range files {
+			if f.done {
+				continue
+			}
+			if len(f.data) == cap(f.data) {
+				// The file grew, let append pick the new size.
+				f.data = append(f.data, 0)[:len(f.data)]
+			}
+			b := f.data[len(f.data):cap(f.data)]
+			if len(b) > maxRW {
+				b = b[:maxRW]
+			}
+			preps = append(preps, prepReadWrite(Read, f.fd, b, int64(len(f.data))))
+			pending = append(pending, f)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		res, err := r.batch(preps...)
+		for i, f := range pending {
+			switch {
+			case err != nil:
+				f.err, f.done = &os.PathError{Op: "read", Path: f.name, Err: err}, true
+			case res[i] < 0 && copyRetry(res[i]):
+			case res[i] < 0:
+				f.err, f.done = &os.PathError{Op: "read", Path: f.name, Err: syscall.Errno(-res[i])}, true
+			case res[i] == 0:
+				f.done = true
+			default:
+				f.data = f.data[:len(f.data)+int(res[i])]
+			}
+		}
+	}
+}
+
+// closeFiles closes the files that were opened, like os.ReadFile errors
+// from closing are ignored.
+func (r *Ring) closeFiles(files []*readFile) {
+	var preps []func(*SubmitEntry)
+	for _, f := range files {
+		if f.fd < 0 {
+			continue
+		}
+		fd := f.fd
+		preps = append(preps, func(sqe *SubmitEntry) {
+			sqe.Opcode = Close
+			sqe.Fd = int32(fd)
+		})
+	}
+	if len(preps) == 0 {
+		return
+	}
+	if _, err := r.batch(preps...); err != nil {
+		for _, f := range files {
+			if f.fd >= 0 {
+				syscall.Close(f.fd)
+			}
+		}
+	}
+}
+
+// WriteFile writes data to the named file like os.WriteFile, the file is
+// created with perm if needed and truncated otherwise. If sync is set the
+// last write is linked to a fsync so that the data is on disk once WriteFile
+// returns.
+func (r *Ring) WriteFile(name string, data []byte, perm os.FileMode, sync bool) error {
+	fd, err := r.OpenAt(
+		unix.AT_FDCWD,
+		name,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_CLOEXEC,
+		syscallMode(perm),
+	)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	var tail []func(*SubmitEntry)
+	if sync {
+		tail = append(tail, func(sqe *SubmitEntry) {
+			prepFsync(sqe, fd, 0)
+		})
+	}
+	res, err := r.writeFile(fd, data, tail...)
+	switch {
+	case err != nil:
+		err = &os.PathError{Op: "write", Path: name, Err: err}
+	case len(res) > 0 && res[0] < 0:
+		err = &os.PathError{Op: "sync", Path: name, Err: syscall.Errno(-res[0])}
+	}
+	if cerr := r.Close(fd); cerr != nil && err == nil {
+		err = &os.PathError{Op: "close", Path: name, Err: cerr}
+	}
+	return err
+}
+
+// writeFile writes data to the start of the fd, the last write is linked to
+// the tail requests. A short write cancels the tail, which is submitted again
+// with the rest of the data. It returns the results of the tail.
+func (r *Ring) writeFile(fd int, data []byte, tail ...func(*SubmitEntry)) ([]int32, error) {
+	off := 0
+	for {
+		b := data[off:]
+		if len(b) > maxRW {
+			b = b[:maxRW]
+		}
+		last := off+len(b) == len(data)
+		var preps []func(*SubmitEntry)
+		if len(b) > 0 {
+			preps = append(preps, prepReadWrite(Write, fd, b, int64(off)))
+		}
+		if last {
+			preps = append(preps, tail...)
+		}
+		if len(preps) == 0 {
+			return nil, nil
+		}
+		res, err := r.link(nil, true, preps...)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > 0 {
+			n := res[0]
+			res = res[1:]
+			if n < 0 && !copyRetry(n) {
+				return nil, syscall.Errno(-n)
+			}
+			if n == 0 {
+				return nil, io.ErrShortWrite
+			}
+			if n > 0 {
+				off += int(n)
+			}
+			if int(n) < len(b) {
+				continue
+			}
+		}
+		if last {
+			return res, nil
+		}
+	}
+}
+
+// WriteFileAtomic replaces the file name in dir with data so that readers
+// see either the old or the new contents. The data is written to a new
+// temporary file in dir and the write, fsync, close, rename over name and
+// fsync of dir are submitted as a single chain. If any step before the rename
+// fails the original file is left intact and the temporary file is removed.
+func (r *Ring) WriteFileAtomic(dir, name string, data []byte, perm os.FileMode) error {
+	path := filepath.Join(dir, name)
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return &os.PathError{Op: "open", Path: path, Err: syscall.EINVAL}
+	}
+	dirfd, err := r.OpenAt(unix.AT_FDCWD, dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer r.Close(dirfd)
+
+	tmp, fd, err := r.createTemp(dirfd, name, perm)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: filepath.Join(dir, tmp), Err: err}
+	}
+	tmpp, _ := syscall.BytePtrFromString(tmp)
+	namep, _ := syscall.BytePtrFromString(name)
+	res, err := r.writeFile(fd, data,
+		func(sqe *SubmitEntry) {
+			prepFsync(sqe, fd, 0)
+		},
+		func(sqe *SubmitEntry) {
+			sqe.Opcode = Close
+			sqe.Fd = int32(fd)
+		},
+		func(sqe *SubmitEntry) {
+			prepRenameAt(sqe, dirfd, tmpp, dirfd, namep, 0)
+		},
+		func(sqe *SubmitEntry) {
+			prepFsync(sqe, dirfd, 0)
+		},
+	)
+	runtime.KeepAlive(tmpp)
+	runtime.KeepAlive(namep)
+	if err == nil && res[2] == 0 {
+		// The file was replaced, only the rename may not be durable.
+		if res[3] < 0 {
+			return &os.PathError{Op: "sync", Path: dir, Err: syscall.Errno(-res[3])}
+		}
+		return nil
+	}
+
+	// The chain stopped before the rename.
+	if err != nil || res[1] == -int32(syscall.ECANCELED) {
+		r.Close(fd)
+	}
+	r.UnlinkAt(dirfd, tmp, 0)
+	switch {
+	case err != nil:
+		return &os.PathError{Op: "write", Path: path, Err: err}
+	case res[0] < 0:
+		return &os.PathError{Op: "sync", Path: path, Err: syscall.Errno(-res[0])}
+	case res[1] < 0:
+		return &os.PathError{Op: "close", Path: path, Err: syscall.Errno(-res[1])}
+	default:
+		return &os.PathError{Op: "rename", Path: path, Err: syscall.Errno(-res[2])}
+	}
+}
+
+// createTemp creates a new file in dirfd for replacing name. The suffix of
+// the file is random so that other processes don't pick the same name.
+func (r *Ring) createTemp(dirfd int, name string, perm os.FileMode) (string, int, error) {
+	var b [8]byte
+	for i := 0; ; i++ {
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", -1, err
+		}
+		tmp := "." + name + "." + strconv.FormatUint(binary.LittleEndian.Uint64(b[:]), 36) + ".tmp"
+		fd, err := r.OpenAt(
+			dirfd,
+			tmp,
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_CLOEXEC,
+			syscallMode(perm),
+		)
+		if err == syscall.EEXIST && i < 10000 {
+			continue
+		}
+		return tmp, fd, err
+	}
+}
@@ -0,0 +1,218 @@
+// +build linux
+
+package iouring
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "readfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{0, 1, 511, 512, 4096, 1<<20 + 3} {
+		name := filepath.Join(dir, fmt.Sprintf("file%d", size))
+		want := make([]byte, size)
+		rand.Read(want)
+		require.NoError(t, ioutil.WriteFile(name, want, 0644))
+		got, err := r.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	// Files that report a size of zero are read until the end.
+	want, err := ioutil.ReadFile("/proc/self/status")
+	require.NoError(t, err)
+	got, err := r.ReadFile("/proc/self/status")
+	require.NoError(t, err)
+	require.Contains(t, string(got), "Name:")
+	require.InDelta(t, len(want), len(got), 512)
+
+	_, err = r.ReadFile(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, "open", err.(*os.PathError).Op)
+	_, err = r.ReadFile(dir)
+	require.Error(t, err)
+	require.Equal(t, "read", err.(*os.PathError).Op)
+	require.Equal(t, syscall.EISDIR, err.(*os.PathError).Err)
+}
+
+func TestReadFiles(t *testing.T) {
+	// More files than fit in the SQ.
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "readfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	names := make([]string, 50)
+	want := make([][]byte, len(names))
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("file%d", i))
+		want[i] = make([]byte, rand.Intn(10000))
+		rand.Read(want[i])
+		require.NoError(t, ioutil.WriteFile(names[i], want[i], 0644))
+	}
+	names[7] = filepath.Join(dir, "missing")
+	names[13] = "bad\x00name"
+
+	data, errs := r.ReadFiles(names)
+	require.Len(t, data, len(names))
+	require.Len(t, errs, len(names))
+	for i := range names {
+		switch i {
+		case 7:
+			require.True(t, os.IsNotExist(errs[i]))
+		case 13:
+			require.Error(t, errs[i])
+		default:
+			require.NoError(t, errs[i])
+			require.Equal(t, want[i], data[i])
+		}
+	}
+}
+
+func TestReadFileGrowing(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "readfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fifo")
+
+	// The size of a fifo is zero, everything written to it is read.
+	require.NoError(t, syscall.Mkfifo(name, 0644))
+	want := make([]byte, 100000)
+	rand.Read(want)
+	go func() {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		for b := want; len(b) > 0; b = b[1000:] {
+			f.Write(b[:1000])
+		}
+	}()
+	got, err := r.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestWriteFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "writefile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+
+	want := make([]byte, 1<<20+7)
+	rand.Read(want)
+	require.NoError(t, r.WriteFile(name, want, 0600, false))
+	got, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600)&^fileUmask(), fi.Mode())
+
+	// The file is truncated.
+	require.NoError(t, r.WriteFile(name, want[:10], 0600, true))
+	got, err = r.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, want[:10], got)
+	require.NoError(t, r.WriteFile(name, nil, 0600, true))
+	got, err = r.ReadFile(name)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	err = r.WriteFile(filepath.Join(dir, "missing", "file"), want, 0600, false)
+	require.True(t, os.IsNotExist(err))
+}
+
+func BenchmarkReadFiles(b *testing.B) {
+	r, err := New(1024, nil)
+	require.NoError(b, err)
+	defer r.Stop()
+
+	dir, names := statFiles(b, 1000)
+	defer os.RemoveAll(dir)
+	for i := range names {
+		names[i] = filepath.Join(dir, names[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, errs := r.ReadFiles(names)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "atomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "state")
+
+	for _, size := range []int{100, 0, 1<<20 + 9} {
+		want := make([]byte, size)
+		rand.Read(want)
+		require.NoError(t, r.WriteFileAtomic(dir, "state", want, 0640))
+		got, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640)&^fileUmask(), fi.Mode())
+
+	// A failed rename leaves the target alone and removes the temporary
+	// file.
+	target := filepath.Join(dir, "target")
+	require.NoError(t, os.Mkdir(target, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "keep"), []byte("keep"), 0644))
+	err = r.WriteFileAtomic(dir, "target", []byte("data"), 0644)
+	require.Error(t, err)
+	require.Equal(t, "rename", err.(*os.PathError).Op)
+	got, err := ioutil.ReadFile(filepath.Join(target, "keep"))
+	require.NoError(t, err)
+	require.Equal(t, "keep", string(got))
+
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	err = r.WriteFileAtomic(filepath.Join(dir, "missing"), "state", nil, 0644)
+	require.True(t, os.IsNotExist(err))
+	err = r.WriteFileAtomic(dir, "sub/state", nil, 0644)
+	require.Equal(t, syscall.EINVAL, err.(*os.PathError).Err)
+}
@@ -67,40 +67,41 @@ func UnregisterEventFd(ringFd int, fd int) error {
 	return nil
 }
 
-// RegisterBuffers is used to register buffers to a ring.
-func RegisterBuffers(fd int, vecs []*syscall.Iovec) error {
+// RegisterBuffers is used to register buffers to a ring as fixed buffers,
+// the memory must stay mapped until the buffers are unregistered.
+func RegisterBuffers(fd int, vecs []syscall.Iovec) error {
+	var p unsafe.Pointer
+	if len(vecs) > 0 {
+		p = unsafe.Pointer(&vecs[0])
+	}
 	_, _, errno := syscall.Syscall6(
 		RegisterSyscall,
 		uintptr(fd),
 		uintptr(RegRegisterBuffers),
-		uintptr(unsafe.Pointer(&vecs[0])),
+		uintptr(p),
 		uintptr(len(vecs)),
 		uintptr(0),
 		uintptr(0),
 	)
-	if errno < 0 {
-		var err error
-		err = errno
-		return err
+	if errno != 0 {
+		return errno
 	}
 	return nil
 }
 
-// UnregisterBuffers is used to unregister iovecs from a ring.
-func UnregisterBuffers(fd int, vecs []*syscall.Iovec) error {
+// UnregisterBuffers is used to unregister the fixed buffers of a ring.
+func UnregisterBuffers(fd int) error {
 	_, _, errno := syscall.Syscall6(
 		RegisterSyscall,
 		uintptr(fd),
 		uintptr(RegUnregisterBuffers),
-		uintptr(unsafe.Pointer(&vecs[0])),
-		uintptr(len(vecs)),
+		uintptr(0),
+		uintptr(0),
 		uintptr(0),
 		uintptr(0),
 	)
-	if errno < 0 {
-		var err error
-		err = errno
-		return err
+	if errno != 0 {
+		return errno
 	}
 	return nil
 }
@@ -15,9 +15,17 @@ func TestRegisterBuffers(t *testing.T) {
 	r, err := New(2048, nil)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	vecs := make([]*syscall.Iovec, 10)
+	defer r.Stop()
+	bufs := make([]byte, 10*4096)
+	vecs := make([]syscall.Iovec, 10)
+	for i := range vecs {
+		vecs[i].Base = &bufs[i*4096]
+		vecs[i].SetLen(4096)
+	}
 	require.NoError(t, RegisterBuffers(r.Fd(), vecs))
-	require.NoError(t, UnregisterBuffers(r.Fd(), vecs))
+	require.Error(t, RegisterBuffers(r.Fd(), vecs))
+	require.NoError(t, UnregisterBuffers(r.Fd()))
+	require.Error(t, UnregisterBuffers(r.Fd()))
 }
 
 func TestFileRegistry(t *testing.T) {
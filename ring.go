@@ -3,6 +3,9 @@
 package iouring
 
 import (
+	"context"
+	"encoding/binary"
+	"io"
 	"os"
 	"runtime"
 	"sync"
@@ -19,10 +22,10 @@ type Ring struct {
 	fd              int
 	p               *Params
 	cq              *CompletionQueue
-	c               *completer
 	cqMu            sync.RWMutex
 	sq              *SubmitQueue
 	sqMu            sync.RWMutex
+	sqTail          uint32
 	sqPool          sync.Pool
 	idx             *uint64
 	debug           bool
@@ -31,10 +34,32 @@ type Ring struct {
 	enterErrHandler func(error)
 	submitter       submitter
 
-	stop           chan struct{}
-	completions    chan *completionRequest
-	eventFd        int
+	stop    chan struct{}
+	stopped chan struct{}
+	eventFd int
+	// wakeFd is an eventfd that wakes up the completion goroutine when
+	// the ring is stopped.
+	wakeFd         int
 	completionPool sync.Pool
+
+	// closeMu is held for writing while the ring is unmapped and closed,
+	// it is always acquired after sqMu or cqMu.
+	closeMu sync.RWMutex
+
+	// pendMu protects the maps used for tracking requests that are in
+	// flight.
+	pendMu sync.Mutex
+	// pending are requests that are waiting for a completion.
+	pending map[uint64]*completionRequest
+	// pins holds references to memory that the kernel may access until
+	// the request with the matching id completes.
+	pins map[uint64]interface{}
+	// dead is set once the ring is stopped, requests waited on after that
+	// are failed immediately.
+	dead bool
+
+	// fixed holds the *AlignedBuffers that are registered with the ring.
+	fixed atomic.Value
 }
 
 // New is used to create an iouring.Ring.
@@ -47,33 +72,35 @@ func New(size uint, p *Params, opts ...RingOption) (*Ring, error) {
 		return nil, err
 	}
 	var (
-		cq       CompletionQueue
-		sq       SubmitQueue
-		sqWrites uint32
+		cq CompletionQueue
+		sq SubmitQueue
 	)
 	if err := MmapRing(fd, p, &sq, &cq); err != nil {
 		return nil, err
 	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
 	idx := uint64(0)
-	entered := uint32(0)
-	sq.entered = &entered
-
-	sq.writes = &sqWrites
 	r := &Ring{
-		p:           p,
-		fd:          fd,
-		cq:          &cq,
-		sq:          &sq,
-		idx:         &idx,
-		fileReg:     nil,
-		eventFd:     -1,
-		stop:        make(chan struct{}, 32),
-		completions: make(chan *completionRequest, len(cq.Entries)),
-		c:           newCompleter(&cq, 512),
+		p:       p,
+		fd:      fd,
+		cq:      &cq,
+		sq:      &sq,
+		sqTail:  atomic.LoadUint32(sq.Tail),
+		idx:     &idx,
+		fileReg: nil,
+		eventFd: -1,
+		wakeFd:  wakeFd,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		pending: map[uint64]*completionRequest{},
+		pins:    map[uint64]interface{}{},
 		completionPool: sync.Pool{
 			New: func() interface{} {
 				return &completionRequest{
-					done: make(chan struct{}, 8),
+					done: make(chan struct{}, 1),
 				}
 			},
 		},
@@ -84,7 +111,6 @@ func New(size uint, p *Params, opts ...RingOption) (*Ring, error) {
 		}
 	}
 	go r.run()
-	go r.c.run()
 
 	return r, nil
 }
@@ -107,160 +133,219 @@ func (r *Ring) EventFd() int {
 
 // Enter is used to enter the ring.
 func (r *Ring) Enter(toSubmit uint, minComplete uint, flags uint, sigset *unix.Sigset_t) (int, error) {
-	// Acquire the submit barrier so that the ring can safely be entered.
+	r.closeMu.RLock()
+	defer r.closeMu.RUnlock()
+	if r.sq == nil {
+		return 0, errRingUnavailable
+	}
 	if r.sq.NeedWakeup() {
 		flags |= EnterSqWakeup
 	}
-	// Increase the write counter as the caller will be
-	// updating the returned SubmitEntry.
-	r.sq.enterLock()
 	// TODO: Document how sigset should be used in relation with the go runtime and
 	// io_uring_enter.
-	completed, err := Enter(r.fd, toSubmit, minComplete, flags, sigset)
-	r.sq.enterUnlock()
-	return completed, err
+	return Enter(r.fd, toSubmit, minComplete, flags, sigset)
+}
+
+// submit is used to submit all SQEs that have been made ready to the kernel.
+func (r *Ring) submit() error {
+	for {
+		select {
+		case <-r.stop:
+			// Requests that are waited on are failed once the
+			// ring is stopped.
+			return errRingUnavailable
+		default:
+		}
+		_, err := r.Enter(uint(r.p.SqEntries), 0, 0, nil)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			// The kernel is out of resources or the CQ has
+			// overflown, give the reaper a chance to catch up.
+			runtime.Gosched()
+		default:
+			if r.enterErrHandler != nil {
+				r.enterErrHandler(err)
+			}
+			return err
+		}
+	}
 }
 
-// run is used to run the ring and handle completions.
+// run is used to run the ring and handle completions. It is the only reader
+// of the completion queue, every CQE is handed to the request waiting on it.
+// The ring fd is polled rather than entered so that Stop can wake it up with
+// the wake eventfd, which doesn't need a free SQE.
 func (r *Ring) run() {
-	inflight := map[uint64]*completionRequest{}
-	retry := make(chan struct{}, 2)
+	defer close(r.stopped)
+	fds := []unix.PollFd{
+		{Fd: int32(r.fd), Events: unix.POLLIN},
+		{Fd: int32(r.wakeFd), Events: unix.POLLIN},
+	}
 	for {
+		_, err := unix.Poll(fds, -1)
 		select {
 		case <-r.stop:
+			r.reap()
 			return
-		case cr := <-r.completions:
-			inflight[cr.id] = cr
-			// TODO: Use the number completed for tracking
-			count, err := r.Enter(uint(len(inflight)), 0, EnterGetEvents, nil)
-			if err != nil {
-				if r.enterErrHandler != nil {
-					r.enterErrHandler(err)
-				}
-				// There still may be completed requests so continue on.
-			}
-			r.onEntry(inflight, count)
-			if len(inflight) > 0 {
-				retry <- struct{}{}
-			}
-		case <-retry:
-			select {
-			case cr := <-r.completions:
-				inflight[cr.id] = cr
-				_, err := r.Enter(uint(len(inflight)), 0, EnterGetEvents, nil)
-				if err != nil {
-					if r.enterErrHandler != nil {
-						r.enterErrHandler(err)
-					}
-				}
-			default:
+		default:
+		}
+		if err != nil && err != syscall.EINTR {
+			if r.enterErrHandler != nil {
+				r.enterErrHandler(err)
 			}
-			r.onEntry(inflight, 0)
-			if len(inflight) > 0 {
-				// TODO: Use eventfd for polling instead.
-				time.Sleep(200 * time.Nanosecond)
-				retry <- struct{}{}
+			// There still may be completed requests so continue on.
+		}
+		if r.ShouldFlush() {
+			// The kernel only moves overflown CQEs to the CQ when
+			// the ring is entered.
+			if _, err := r.Enter(0, 0, EnterGetEvents, nil); err != nil && r.enterErrHandler != nil {
+				r.enterErrHandler(err)
 			}
 		}
+		r.reap()
+	}
+}
+
+// reap is used to consume all available CQEs.
+func (r *Ring) reap() {
+	head := atomic.LoadUint32(r.cq.Head)
+	tail := atomic.LoadUint32(r.cq.Tail)
+	if head == tail {
+		return
+	}
+	mask := atomic.LoadUint32(r.cq.Mask)
+
+	r.pendMu.Lock()
+	for ; head != tail; head++ {
+		cqe := r.cq.Entries[head&mask]
+		delete(r.pins, cqe.UserData)
+		// Requests are waited on before they are submitted, so the
+		// CQEs of requests that nothing waits on are dropped.
+		if cr, ok := r.pending[cqe.UserData]; ok {
+			delete(r.pending, cqe.UserData)
+			cr.res = cqe.Res
+			cr.flags = cqe.Flags
+			cr.done <- struct{}{}
+		}
 	}
+	r.pendMu.Unlock()
+	atomic.StoreUint32(r.cq.Head, tail)
+}
+
+// pin is used to keep memory referenced by a SQE alive until the request
+// completes.
+func (r *Ring) pin(reqID uint64, v interface{}) {
+	r.pendMu.Lock()
+	r.pins[reqID] = v
+	r.pendMu.Unlock()
 }
 
-func (r *Ring) complete(reqID uint64) (int32, uint32) {
+// wait returns a completionRequest that is signaled once the CQE for the
+// request id is available. It must be called before the SQE of the request is
+// made ready, otherwise the CQE may be dropped before it is waited on.
+func (r *Ring) wait(reqID uint64) *completionRequest {
 	req := r.completionPool.Get().(*completionRequest)
 	req.id = reqID
 	req.res = 0
 	req.flags = 0
-	r.completions <- req
-	<-req.done
-	res := req.res
-	flags := req.flags
+
+	r.pendMu.Lock()
+	if r.dead {
+		req.res = -int32(syscall.ECANCELED)
+		req.done <- struct{}{}
+	} else {
+		r.pending[reqID] = req
+	}
+	r.pendMu.Unlock()
+	return req
+}
+
+// release returns a finished completionRequest to the pool.
+func (r *Ring) release(req *completionRequest) (int32, uint32) {
+	res, flags := req.res, req.flags
 	r.completionPool.Put(req)
 	return res, flags
 }
 
-func (r *Ring) onEntry(inflight map[uint64]*completionRequest, count int) {
-	mask := atomic.LoadUint32(r.cq.Mask)
-	head := atomic.LoadUint32(r.cq.Head)
-	tail := atomic.LoadUint32(r.cq.Tail)
-	nEntries := uint32(len(r.cq.Entries))
-	seenIdx := uint32(0)
-	seen := true
-	for i := head & mask; i < nEntries; i++ {
-		cqe := r.cq.Entries[i]
-		if cr, ok := inflight[cqe.UserData]; ok {
-			if seen {
-				seenIdx++
-			}
-			cr.res = cqe.Res
-			cr.flags = cqe.Flags
-			cr.done <- struct{}{}
-			delete(inflight, cr.id)
-		} else {
-			seen = false
-		}
-		if i == tail&mask {
-			atomic.StoreUint32(r.cq.Head, head+seenIdx)
-			return
-		}
+// prepare is used by the Prepare methods to prepare a SQE and make it ready,
+// v is kept alive until the request completes. Nothing waits on the request
+// so its CQE is dropped.
+func (r *Ring) prepare(v interface{}, prep func(*SubmitEntry)) (uint64, error) {
+	sqe, ready := r.SubmitEntry()
+	if sqe == nil {
+		return 0, errRingUnavailable
 	}
-	seen = true
-	for i := uint32(0); i < tail&mask; i++ {
-		cqe := r.cq.Entries[i]
-		if cr, ok := inflight[cqe.UserData]; ok {
-			if seen {
-				seenIdx++
-			}
-			cr.res = cqe.Res
-			cr.flags = cqe.Flags
-			cr.done <- struct{}{}
-			delete(inflight, cr.id)
-		} else {
-			seen = false
-		}
+	prep(sqe)
+	sqe.UserData = r.ID()
+	if v != nil {
+		r.pin(sqe.UserData, v)
 	}
-	atomic.StoreUint32(r.cq.Head, head+seenIdx)
+	ready()
+	return sqe.UserData, nil
 }
 
-// getCqe is used for getting a CQE result.
-func (r *Ring) getCqe(reqID uint64) (int32, uint32, error) {
-	cq := r.cq
-findCqe:
+// complete prepares a request, submits it and blocks until it completes. It
+// returns the result and flags of the CQE.
+func (r *Ring) complete(prep func(*SubmitEntry)) (int32, uint32, error) {
+	return r.completeCtx(context.Background(), prep)
+}
 
-	head := atomic.LoadUint32(cq.Head)
-	tail := atomic.LoadUint32(cq.Tail)
-	mask := atomic.LoadUint32(cq.Mask)
-	end := int(tail & mask)
+// completeCtx is like complete, only the request is canceled once the context
+// is done. The request is always waited on so that any memory used by it
+// is safe to reuse once this returns.
+func (r *Ring) completeCtx(ctx context.Context, prep func(*SubmitEntry)) (int32, uint32, error) {
+	sqe, ready := r.SubmitEntry()
+	if sqe == nil {
+		return 0, 0, errRingUnavailable
+	}
+	prep(sqe)
+	id := r.ID()
+	sqe.UserData = id
+	req := r.wait(id)
+	ready()
+	if err := r.submit(); err != nil {
+		r.fail(id, err)
+	}
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		r.cancel(id)
+		<-req.done
+	}
+	res, flags := r.release(req)
+	return res, flags, nil
+}
 
-	for x := int(head & mask); x < len(cq.Entries); x++ {
-		cqe := cq.Entries[x]
-		if cqe.UserData == reqID {
-			if cqe.Res < 0 {
-				return 0, 0, syscall.Errno(-cqe.Res)
-			}
-			return cqe.Res, cqe.Flags, nil
-		}
-		if x == end {
-			goto findCqe
-			return 0, 0, errCQEMissing
-		}
+// fail is used to complete a request that could not be submitted.
+func (r *Ring) fail(reqID uint64, err error) {
+	errno, ok := err.(syscall.Errno)
+	switch {
+	case err == errRingUnavailable:
+		// Like the requests that are failed by Stop.
+		errno = syscall.ECANCELED
+	case !ok:
+		errno = syscall.EIO
 	}
-	tail = atomic.LoadUint32(cq.Tail)
-	mask = atomic.LoadUint32(cq.Mask)
-	end = int(tail & mask)
-	for x := 0; x < end; x++ {
-		cqe := cq.Entries[x]
-		if cqe.UserData == reqID {
-			if cqe.Res < 0 {
-				return 0, 0, syscall.Errno(-cqe.Res)
-			}
-			return cqe.Res, cqe.Flags, nil
-		}
-		if x == end {
-			goto findCqe
-			return 0, 0, errCQEMissing
-		}
+	r.pendMu.Lock()
+	if cr, ok := r.pending[reqID]; ok {
+		delete(r.pending, reqID)
+		cr.res = -int32(errno)
+		cr.done <- struct{}{}
+	}
+	r.pendMu.Unlock()
+}
+
+// cancel is used to cancel an in flight request, it returns once the cancel
+// request has completed. The canceled request will still have a CQE.
+func (r *Ring) cancel(reqID uint64) {
+	_, _, err := r.complete(func(sqe *SubmitEntry) {
+		prepAsyncCancel(sqe, reqID, 0)
+	})
+	if err != nil {
+		r.fail(reqID, err)
 	}
-	return 0, 0, errCQEMissing
 }
 
 // CanEnter returns whether or not the ring can be entered.
@@ -281,23 +366,49 @@ func (r *Ring) NeedsEnter() bool {
 
 // Stop is used to stop the ring.
 func (r *Ring) Stop() error {
+	select {
+	case <-r.stop:
+		return nil
+	default:
+	}
+	close(r.stop)
+	// Wake up the completion goroutine, which will exit once it sees the
+	// ring has been stopped.
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	if _, err := syscall.Write(r.wakeFd, one[:]); err != nil {
+		return err
+	}
+	<-r.stopped
+	syscall.Close(r.wakeFd)
+	if r.submitter != nil {
+		r.submitter.stop()
+	}
 	if err := r.closeSq(); err != nil {
 		return err
 	}
+	// Nothing will complete the requests that are still waited on.
+	r.pendMu.Lock()
+	r.dead = true
+	for id, cr := range r.pending {
+		delete(r.pending, id)
+		cr.res = -int32(syscall.ECANCELED)
+		cr.done <- struct{}{}
+	}
+	r.pendMu.Unlock()
 	if r.p.Flags&FeatSingleMmap == 0 {
 		if err := r.closeCq(); err != nil {
 			return err
 		}
 	}
-	if r.submitter != nil {
-		r.submitter.stop()
-	}
 	return syscall.Close(r.fd)
 }
 
 func (r *Ring) closeCq() error {
 	r.cqMu.Lock()
 	defer r.cqMu.Unlock()
+	r.closeMu.Lock()
+	defer r.closeMu.Unlock()
 	if r.cq == nil {
 		return nil
 	}
@@ -322,6 +433,8 @@ func (r *Ring) closeCq() error {
 func (r *Ring) closeSq() error {
 	r.sqMu.Lock()
 	defer r.sqMu.Unlock()
+	r.closeMu.Lock()
+	defer r.closeMu.Unlock()
 	if r.sq == nil {
 		return nil
 	}
@@ -368,39 +481,88 @@ func (r *Ring) CompleteTail() int {
 }
 
 // SubmitEntry returns the next available SubmitEntry or nil if the ring is
-// busy. The returned function should be called after SubmitEntry is ready to
-// enter the ring.
+// unavailable. The returned function must be called after SubmitEntry is ready
+// to enter the ring, no other SubmitEntry can be acquired until it is called.
 func (r *Ring) SubmitEntry() (*SubmitEntry, func()) {
+	sqes, ready := r.submitEntries(1)
+	if sqes == nil {
+		return nil, ready
+	}
+	return sqes[0], ready
+}
+
+// submitEntries returns n consecutive SubmitEntries, which is required for
+// linking SQEs. The entries are made visible to the kernel all at once when
+// the returned function is called.
+func (r *Ring) submitEntries(n int) ([]*SubmitEntry, func()) {
 	// This function roughly follows this:
 	// https://github.com/axboe/liburing/blob/master/src/queue.c#L258
-
-getNext:
-	tail := atomic.LoadUint32(r.sq.Tail)
-	head := atomic.LoadUint32(r.sq.Head)
-	mask := atomic.LoadUint32(r.sq.Mask)
-	next := tail&mask + 1
-	if next <= uint32(len(r.sq.Entries)) {
-		// Make sure the ring is safe for updating by acquring the
-		// update barrier.
-		if !atomic.CompareAndSwapUint32(r.sq.Tail, tail, next) {
-			runtime.Gosched()
-			goto getNext
+	r.sqMu.Lock()
+	select {
+	case <-r.stop:
+		// Nothing submits the entries once the ring is stopped.
+		r.sqMu.Unlock()
+		return nil, func() {}
+	default:
+	}
+	if r.sq == nil || n > len(r.sq.Entries) {
+		r.sqMu.Unlock()
+		return nil, func() {}
+	}
+	entries := uint32(len(r.sq.Entries))
+	for r.sqTail+uint32(n)-atomic.LoadUint32(r.sq.Head) > entries {
+		// The SQ is full, so flush the ready entries to the kernel.
+		if err := r.submit(); err != nil {
+			r.sqMu.Unlock()
+			return nil, func() {}
 		}
-		if atomic.LoadUint32(r.sq.entered) != 0 {
-			runtime.Gosched()
-			goto getNext
+	}
+	mask := atomic.LoadUint32(r.sq.Mask)
+	sqes := make([]*SubmitEntry, n)
+	for i := range sqes {
+		idx := (r.sqTail + uint32(i)) & mask
+		r.sq.Entries[idx].Reset()
+		sqes[i] = &r.sq.Entries[idx]
+	}
+	return sqes, func() {
+		for i := 0; i < n; i++ {
+			idx := r.sqTail & mask
+			r.sq.Array[idx] = idx
+			r.sqTail++
 		}
-		atomic.AddUint32(r.sq.writes, 1)
+		atomic.StoreUint32(r.sq.Tail, r.sqTail)
+		r.sqMu.Unlock()
+	}
+}
 
-		r.sq.Entries[tail&mask].Reset()
-		return &r.sq.Entries[tail&mask], func() {
-			r.sq.completeWrite()
-			r.sq.Array[next-1] = head & mask
+// batch submits the prepared requests at once without linking them and
+// waits for all of them, at most the size of the SQ can be submitted. A
+// prepare func may set SqeIoLink itself to link its request to the next.
+func (r *Ring) batch(preps ...func(*SubmitEntry)) ([]int32, error) {
+	sqes, ready := r.submitEntries(len(preps))
+	if sqes == nil {
+		return nil, errRingUnavailable
+	}
+	ids := make([]uint64, len(preps))
+	reqs := make([]*completionRequest, len(preps))
+	for i, prep := range preps {
+		prep(sqes[i])
+		ids[i] = r.ID()
+		sqes[i].UserData = ids[i]
+		reqs[i] = r.wait(ids[i])
+	}
+	ready()
+	if err := r.submit(); err != nil {
+		for _, id := range ids {
+			r.fail(id, err)
 		}
 	}
-	// When the ring wraps restart.
-	atomic.CompareAndSwapUint32(r.sq.Tail, tail, 0)
-	goto getNext
+	res := make([]int32, len(reqs))
+	for i, req := range reqs {
+		<-req.done
+		res[i], _ = r.release(req)
+	}
+	return res, nil
 }
 
 // ID returns an id for a SQEs, it is a monotonically increasing value (until
@@ -420,25 +582,30 @@ func (r *Ring) FileRegistry() FileRegistry {
 }
 
 // FileReadWriter returns an io.ReadWriter from an os.File that uses the ring.
-// Note that is is not valid to use other operations on the file (Seek/Close)
+// It starts at the current offset of the file and keeps its own offset, which
+// behaves like the offset of an os.File. Note that is is not valid to use other operations on the file (Seek/Close)
 // in combination with the reader.
 func (r *Ring) FileReadWriter(f *os.File) (ReadWriteSeekerCloser, error) {
 	return r.fileReadWriter(f)
 }
 
 func (r *Ring) fileReadWriter(f *os.File) (*ringFIO, error) {
-	var offset int64
-	o, err := f.Seek(0, 0)
+	offset, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
-	offset = int64(o)
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("fcntl", err)
+	}
 	rw := &ringFIO{
 		r:       r,
 		f:       f,
+		name:    f.Name(),
 		fd:      int32(f.Fd()),
 		fOffset: &offset,
-		c:       r.c,
+		append:  flags&unix.O_APPEND != 0,
+		direct:  flags&unix.O_DIRECT != 0,
 	}
 	if r.fileReg == nil {
 		return rw, nil
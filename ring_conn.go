@@ -3,147 +3,265 @@
 package iouring
 
 import (
-	"context"
+	"io"
 	"net"
+	"os"
 	"runtime"
 	"sync"
 	"syscall"
 	"time"
 	"unsafe"
-
-	"github.com/pkg/errors"
 )
 
 // ringConn is a net.Conn that is backed by the Ring.
 type ringConn struct {
-	fd        int
-	laddr     *addr
-	raddr     *addr
-	r         *Ring
-	offset    *int64
-	stop      chan struct{}
-	poll      chan uint64
-	pollReady *int32
-
-	deadMu        sync.RWMutex
-	deadline      time.Time
-	readDeadline  time.Time
-	writeDeadline time.Time
-}
-
-// getCqe is used for getting a CQE result.
-func (c *ringConn) getCqe(ctx context.Context, reqID uint64) (int, error) {
-	// TODO: Where should this repoll go?
-	_, err := c.r.Enter(uint(1024), uint(1), EnterGetEvents, nil)
+	fd    int
+	laddr *addr
+	raddr *addr
+	r     *Ring
+
+	rd ioDeadline
+	wd ioDeadline
+
+	// rmu and wmu serialize reads and writes, so that the data of
+	// concurrent writes is not interleaved.
+	rmu sync.Mutex
+	wmu sync.Mutex
+
+	// release is called once the connection is closed.
+	release func()
+}
+
+// Read implements the net.Conn interface.
+func (c *ringConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	res, err := c.rd.do(c.r, func(sqe *SubmitEntry) {
+		sqe.Opcode = Recv
+		sqe.Fd = int32(c.fd)
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
+		sqe.Len = uint32(len(b))
+	})
+	runtime.KeepAlive(b)
 	if err != nil {
-		return 0, err
-	}
-	c.stop <- struct{}{}
-	var cqe *CompletionEntry
-	for {
-		select {
-		case <-ctx.Done():
-			return 0, syscall.ETIMEDOUT
-		default:
-		}
-		cqe, err = c.r.cq.EntryBy(reqID)
-		if err != nil {
-			// TODO: How many tries should looking for the cqe be
-			// tried?
-			if err != ErrEntryNotFound {
-				continue
-			}
-			return 0, err
-		}
-		break
+		return 0, c.opError("read", err)
 	}
-	res := int(cqe.Res)
 	if res < 0 {
-		return 0, syscall.Errno(-res)
+		return 0, c.opError("read", syscall.Errno(-res))
 	}
-
-	return res, nil
-}
-
-func (c *ringConn) rePoll() {
-	// Reenable the poll on the connection.
-	id := c.r.ID()
-	sqe, commit := c.r.SubmitEntry()
-	sqe.Opcode = PollAdd
-	sqe.Fd = int32(c.fd)
-	sqe.UFlags = int32(POLLIN)
-	sqe.UserData = id
-	commit()
-	c.r.Enter(uint(1024), uint(1), EnterGetEvents, nil)
+	if res == 0 {
+		return 0, io.EOF
+	}
+	return int(res), nil
 }
 
-func (c *ringConn) run() {
-	for {
-		select {
-		case <-c.stop:
-			id := c.r.ID()
-			sqe, commit := c.r.SubmitEntry()
-			sqe.Opcode = PollRemove
+// Write implements the net.Conn interface.
+func (c *ringConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for n < len(b) {
+		p := b[n:]
+		res, err := c.wd.do(c.r, func(sqe *SubmitEntry) {
+			sqe.Opcode = Send
 			sqe.Fd = int32(c.fd)
-			sqe.UserData = id
-			commit()
-			c.getCqe(context.Background(), id)
-			return
+			sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&p[0])))
+			sqe.Len = uint32(len(p))
+		})
+		if err != nil {
+			runtime.KeepAlive(b)
+			return n, c.opError("write", err)
+		}
+		if res < 0 {
+			runtime.KeepAlive(b)
+			return n, c.opError("write", syscall.Errno(-res))
 		}
+		if res == 0 {
+			runtime.KeepAlive(b)
+			return n, c.opError("write", io.ErrShortWrite)
+		}
+		n += int(res)
 	}
+	runtime.KeepAlive(b)
+	return n, nil
 }
 
-// Read implements the net.Conn interface.
-func (c *ringConn) Read(b []byte) (int, error) {
-	c.rePoll()
-	sqe, commit := c.r.SubmitEntry()
-	if sqe == nil {
-		return 0, errors.New("ring unavailable")
-	}
-
-	sqe.Opcode = ReadFixed
-	sqe.Fd = int32(c.fd)
-	sqe.Len = uint32(len(b))
-	sqe.Flags = 0
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-	// Use reqId as user data so we can return the request from the
-	// completion queue.
-	reqID := c.r.ID()
-	sqe.UserData = reqID
-	commit()
-	ctx := context.Background()
-
-	n, err := c.getCqe(ctx, reqID)
-	runtime.KeepAlive(b)
+// ReadFrom implements the io.ReaderFrom interface, data is spliced from src
+// when possible.
+func (c *ringConn) ReadFrom(src io.Reader) (int64, error) {
+	c.wmu.Lock()
+	n, ok, err := c.r.spliceFrom(spliceEnd{fd: c.fd, poll: POLLOUT, d: &c.wd}, src)
+	c.wmu.Unlock()
+	if !ok {
+		var m int64
+		m, err = genericReadFrom(c, src)
+		n += m
+	}
+	if err != nil {
+		if _, ok := err.(*net.OpError); !ok {
+			err = c.opError("readfrom", err)
+		}
+	}
 	return n, err
 }
 
-// Write implements the net.Conn interface.
-func (c *ringConn) Write(b []byte) (n int, err error) {
-	sqe, commit := c.r.SubmitEntry()
-	if sqe == nil {
-		return 0, errors.New("ring unavailable")
-	}
-
-	sqe.Opcode = WriteFixed
-	sqe.Fd = int32(c.fd)
-	sqe.Len = uint32(len(b))
-	sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&b[0])))
-	// Use reqId as user data so we can return the request from the
-	// completion queue.
-	reqID := c.r.ID()
-	sqe.UserData = reqID
-	commit()
-
-	n, err = c.getCqe(context.Background(), reqID)
-	runtime.KeepAlive(b)
+// WriteTo implements the io.WriterTo interface, data is spliced to dst when
+// possible.
+func (c *ringConn) WriteTo(dst io.Writer) (int64, error) {
+	c.rmu.Lock()
+	n, ok, err := c.r.spliceTo(dst, spliceEnd{fd: c.fd, poll: POLLIN, d: &c.rd})
+	c.rmu.Unlock()
+	if !ok {
+		var m int64
+		m, err = genericWriteTo(c, dst)
+		n += m
+	}
+	if err != nil {
+		if _, ok := err.(*net.OpError); !ok {
+			err = c.opError("writeto", err)
+		}
+	}
 	return n, err
 }
 
+func (c *ringConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.laddr.Network(), Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
 // Close implements the net.Conn interface.
 func (c *ringConn) Close() error {
-	c.stop <- struct{}{}
-	return syscall.Close(c.fd)
+	if !c.rd.close(c.r) {
+		return c.opError("close", errClosed)
+	}
+	// Pending requests are canceled before the fd is closed so that the
+	// fd can't be reused while they are still in flight.
+	c.wd.close(c.r)
+	err := syscall.Close(c.fd)
+	if c.release != nil {
+		c.release()
+	}
+	return err
+}
+
+// CloseRead shuts down the reading side of the connection.
+func (c *ringConn) CloseRead() error {
+	return c.shutdown(syscall.SHUT_RD)
+}
+
+// CloseWrite shuts down the writing side of the connection, the peer reads
+// EOF once any data that was written is read.
+func (c *ringConn) CloseWrite() error {
+	return c.shutdown(syscall.SHUT_WR)
+}
+
+func (c *ringConn) shutdown(how int) error {
+	// The shutdown is done as a write request so that Close can't close
+	// the fd while it is in flight. Like shutdown(2) it ignores the
+	// deadline.
+	res, err := c.wd.doIgnoreDeadline(c.r, func(sqe *SubmitEntry) {
+		prepShutdown(sqe, c.fd, how)
+	})
+	if err != nil {
+		return c.opError("close", err)
+	}
+	if res < 0 {
+		return c.opError("close", os.NewSyscallError("shutdown", syscall.Errno(-res)))
+	}
+	return nil
+}
+
+// SyscallConn implements the syscall.Conn interface.
+func (c *ringConn) SyscallConn() (syscall.RawConn, error) {
+	return &rawConn{r: c.r, fd: c.fd, rd: &c.rd, wd: &c.wd}, nil
+}
+
+// File returns a copy of the underlying os.File, it is the caller's
+// responsibility to close it. Closing the file does not close the connection
+// and changes to the file don't affect the connection.
+func (c *ringConn) File() (*os.File, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	cerr := c.control(func(fd int) {
+		f, err = dupFile(fd, c.laddr.Network()+":"+c.laddr.String()+"->"+c.raddr.String())
+	})
+	if cerr != nil {
+		return nil, c.opError("file", cerr)
+	}
+	if err != nil {
+		return nil, c.opError("file", err)
+	}
+	return f, nil
+}
+
+// SetKeepAlive sets whether the operating system should send keep-alive
+// messages on the connection.
+func (c *ringConn) SetKeepAlive(keepalive bool) error {
+	return c.setsockoptInt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, boolint(keepalive))
+}
+
+// SetNoDelay controls whether the operating system should delay packet
+// transmission in hopes of sending fewer packets (Nagle's algorithm).
+func (c *ringConn) SetNoDelay(noDelay bool) error {
+	return c.setsockoptInt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY, boolint(noDelay))
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer
+// associated with the connection.
+func (c *ringConn) SetReadBuffer(bytes int) error {
+	return c.setsockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUF, bytes)
+}
+
+// SetLinger sets the behavior of Close on a connection which still has data
+// waiting to be sent or to be acknowledged, see net.TCPConn.SetLinger.
+func (c *ringConn) SetLinger(sec int) error {
+	var l syscall.Linger
+	if sec >= 0 {
+		l.Onoff = 1
+		l.Linger = int32(sec)
+	}
+	var err error
+	cerr := c.control(func(fd int) {
+		err = syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &l)
+	})
+	return c.setError(cerr, err)
+}
+
+func (c *ringConn) setsockoptInt(level, opt, value int) error {
+	var err error
+	cerr := c.control(func(fd int) {
+		err = syscall.SetsockoptInt(fd, level, opt, value)
+	})
+	return c.setError(cerr, err)
+}
+
+func (c *ringConn) setError(cerr, err error) error {
+	if cerr != nil {
+		return c.opError("set", cerr)
+	}
+	if err != nil {
+		return c.opError("set", os.NewSyscallError("setsockopt", err))
+	}
+	return nil
+}
+
+// control calls f with the fd unless the connection is closed.
+func (c *ringConn) control(f func(fd int)) error {
+	raw := rawConn{r: c.r, fd: c.fd, rd: &c.rd, wd: &c.wd}
+	return raw.Control(func(fd uintptr) {
+		f(int(fd))
+	})
+}
+
+func boolint(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // LocalAddr implements the net.Conn interface.
@@ -158,24 +276,19 @@ func (c *ringConn) RemoteAddr() net.Addr {
 
 // SetDeadline implements the net.Conn interface.
 func (c *ringConn) SetDeadline(t time.Time) error {
-	c.deadMu.Lock()
-	c.deadline = t
-	c.deadMu.Unlock()
+	c.rd.set(c.r, t)
+	c.wd.set(c.r, t)
 	return nil
 }
 
 // SetReadDeadline implements the net.Conn interface.
 func (c *ringConn) SetReadDeadline(t time.Time) error {
-	c.deadMu.Lock()
-	c.readDeadline = t
-	c.deadMu.Unlock()
+	c.rd.set(c.r, t)
 	return nil
 }
 
-// SetWriteDeadline the net.Conn interface.
+// SetWriteDeadline implements the net.Conn interface.
 func (c *ringConn) SetWriteDeadline(t time.Time) error {
-	c.deadMu.Lock()
-	c.writeDeadline = t
-	c.deadMu.Unlock()
+	c.wd.set(c.r, t)
 	return nil
 }
@@ -0,0 +1,498 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// ringConnPair returns a ring based connection that is connected to a
+// stdlib connection.
+func ringConnPair(t *testing.T, r *Ring) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := r.Dial("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	peer, ok := <-accepted
+	require.True(t, ok)
+	return conn, peer
+}
+
+func requireTimeout(t *testing.T, err error) {
+	require.Error(t, err)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok, "%T is not a net.Error", err)
+	require.True(t, nerr.Timeout())
+}
+
+func TestRingConnReadDeadline(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 8))
+	requireTimeout(t, err)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// A deadline in the past fails without blocking.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Read(make([]byte, 8))
+	requireTimeout(t, err)
+
+	// Clearing the deadline allows reads again.
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	_, err = peer.Write([]byte("ok"))
+	require.NoError(t, err)
+	buf := make([]byte, 8)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(buf[:n]))
+}
+
+func TestRingConnDeadlineInFlight(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	// Shortening the deadline of a blocked read times it out.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 8))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, conn.SetReadDeadline(time.Now()))
+	select {
+	case err := <-errs:
+		requireTimeout(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not interrupted")
+	}
+
+	// Extending the deadline of a blocked read keeps it blocked.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	res := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 8)
+		n, err := conn.Read(buf)
+		if err != nil {
+			errs <- err
+			return
+		}
+		res <- string(buf[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Minute)))
+	time.Sleep(100 * time.Millisecond)
+	_, err = peer.Write([]byte("late"))
+	require.NoError(t, err)
+	select {
+	case s := <-res:
+		require.Equal(t, "late", s)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not complete")
+	}
+}
+
+func TestRingConnWriteDeadline(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	// The peer never reads so the write eventually blocks.
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	b := make([]byte, 1<<20)
+	var n int
+	for {
+		var m int
+		m, err = conn.Write(b)
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	requireTimeout(t, err)
+	require.True(t, n > 0)
+}
+
+func TestRingConnConcurrentWrites(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	// Large writes are sent in many parts, the parts of concurrent writes
+	// must not be interleaved. The writes of 'b' use WriteBuffers.
+	const size = 8 << 20
+	var wg sync.WaitGroup
+	for _, c := range []byte{'a', 'b'} {
+		wg.Add(1)
+		go func(c byte) {
+			defer wg.Done()
+			b := make([]byte, size)
+			for i := range b {
+				b[i] = c
+			}
+			if c == 'b' {
+				n, err := conn.(BuffersWriter).WriteBuffers([][]byte{b[:size/2], b[size/2:]})
+				require.NoError(t, err)
+				require.Equal(t, int64(size), n)
+				return
+			}
+			n, err := conn.Write(b)
+			require.NoError(t, err)
+			require.Equal(t, size, n)
+		}(c)
+	}
+	got := make([]byte, 2*size)
+	_, err = io.ReadFull(peer, got)
+	require.NoError(t, err)
+	wg.Wait()
+	for _, half := range [][]byte{got[:size], got[size:]} {
+		for _, c := range half {
+			if c != half[0] {
+				t.Fatal("concurrent writes were interleaved")
+			}
+		}
+	}
+	require.NotEqual(t, got[0], got[size])
+}
+
+func TestRingConnNettest(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		l, err := r.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer l.Close()
+		c1, err := r.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c2, err := l.Accept()
+		if err != nil {
+			c1.Close()
+			return nil, nil, nil, err
+		}
+		return c1, c2, func() {
+			c1.Close()
+			c2.Close()
+		}, nil
+	})
+}
+
+func TestRingConnCloseBlockedRead(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer peer.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 8))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, conn.Close())
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+		require.NotEqual(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not interrupted by close")
+	}
+	_, err = conn.Write([]byte("closed"))
+	require.Error(t, err)
+	require.Error(t, conn.Close())
+}
+
+func TestListenerStress(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", "127.0.0.1:0", WithAccepts(4))
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	const conns = 64
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := r.Dial("tcp", l.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			msg := make([]byte, 4096)
+			for j := range msg {
+				msg[j] = byte(i + j)
+			}
+			if _, err := conn.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				errs <- err
+				return
+			}
+			if string(buf) != string(msg) {
+				errs <- io.ErrUnexpectedEOF
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+// TestRingConnHTTPS serves HTTPS over ring connections on both the client
+// and server side.
+func TestRingConnHTTPS(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	l, err := r.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello " + req.URL.Path))
+	}))
+	s.Listener.Close()
+	s.Listener = l
+	s.StartTLS()
+	defer s.Close()
+
+	client := s.Client()
+	client.Transport.(*http.Transport).DialContext = r.DialContext
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := client.Get(s.URL + path)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, "hello "+path, string(body))
+		require.NotNil(t, resp.TLS)
+	}
+}
+
+func TestRingConnCloseWrite(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	// Like *net.TCPConn an expired write deadline doesn't stop the
+	// shutdown.
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+
+	// The peer reads the request until EOF and is still able to reply.
+	b, err := ioutil.ReadAll(peer)
+	require.NoError(t, err)
+	require.Equal(t, "request", string(b))
+	_, err = peer.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, peer.Close())
+
+	b, err = ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "response", string(b))
+
+	_, err = conn.Write([]byte("more"))
+	require.Error(t, err)
+}
+
+func TestRingConnCloseRead(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer peer.Close()
+
+	require.NoError(t, conn.(interface{ CloseRead() error }).CloseRead())
+	_, err = conn.Read(make([]byte, 8))
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, conn.Close())
+	require.Error(t, conn.(interface{ CloseRead() error }).CloseRead())
+}
+
+func TestRingConnSockopts(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	c, peer := ringConnPair(t, r)
+	defer peer.Close()
+	conn := c.(*ringConn)
+
+	getInt := func(level, opt int) int {
+		var (
+			v    int
+			gerr error
+		)
+		raw, err := conn.SyscallConn()
+		require.NoError(t, err)
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			v, gerr = syscall.GetsockoptInt(int(fd), level, opt)
+		}))
+		require.NoError(t, gerr)
+		return v
+	}
+
+	require.NoError(t, conn.SetKeepAlive(true))
+	require.Equal(t, 1, getInt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	require.NoError(t, conn.SetNoDelay(true))
+	require.Equal(t, 1, getInt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	require.NoError(t, conn.SetNoDelay(false))
+	require.Equal(t, 0, getInt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	require.NoError(t, conn.SetReadBuffer(1<<16))
+	require.True(t, getInt(syscall.SOL_SOCKET, syscall.SO_RCVBUF) >= 1<<16)
+	require.NoError(t, conn.SetLinger(5))
+
+	require.NoError(t, conn.Close())
+	require.Error(t, conn.SetNoDelay(true))
+	raw, err := conn.SyscallConn()
+	require.NoError(t, err)
+	require.Error(t, raw.Control(func(uintptr) {}))
+}
+
+func TestRingConnFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	c, peer := ringConnPair(t, r)
+	defer peer.Close()
+	conn := c.(*ringConn)
+
+	f, err := conn.File()
+	require.NoError(t, err)
+	require.NotEqual(t, uintptr(conn.fd), f.Fd())
+	require.NoError(t, f.Close())
+
+	// Closing the file doesn't affect the connection.
+	_, err = conn.Write([]byte("ok"))
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Close())
+	_, err = conn.File()
+	require.Error(t, err)
+}
+
+func TestRingConnRawRead(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	c, peer := ringConnPair(t, r)
+	defer c.Close()
+	defer peer.Close()
+
+	raw, err := c.(syscall.Conn).SyscallConn()
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		peer.Write([]byte("raw"))
+	}()
+	var (
+		calls int
+		n     int
+		buf   = make([]byte, 8)
+	)
+	require.NoError(t, raw.Read(func(fd uintptr) bool {
+		calls++
+		n, err = syscall.Read(int(fd), buf)
+		return err != syscall.EAGAIN
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "raw", string(buf[:n]))
+	require.True(t, calls > 1)
+
+	// The poll uses the read deadline.
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	err = raw.Read(func(fd uintptr) bool {
+		_, err := syscall.Read(int(fd), buf)
+		return err != syscall.EAGAIN
+	})
+	requireTimeout(t, err)
+}
@@ -3,7 +3,11 @@
 package iouring
 
 import (
+	"context"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -40,3 +44,117 @@ func TestNewRingInvalidSize(t *testing.T) {
 	_, err := New(99999, nil)
 	require.Error(t, err)
 }
+
+func TestRingManyInFlight(t *testing.T) {
+	// Many more requests than SQ entries so the SQ and CQ wrap.
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if err := r.Nop(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, *r.sq.Head, *r.sq.Tail)
+	require.Equal(t, *r.cq.Head, *r.cq.Tail)
+}
+
+func TestRingStopFullSQ(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+
+	// Stop doesn't need a free SQE to wake up the completion goroutine.
+	for i := 0; i < 8; i++ {
+		_, err := r.PrepareNop()
+		require.NoError(t, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Stop()
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
+
+	// Nothing is submitted once the ring is stopped.
+	_, err = r.PrepareNop()
+	require.Equal(t, errRingUnavailable, err)
+	require.Equal(t, errRingUnavailable, r.Nop())
+}
+
+func TestRingDropsUnwaited(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+
+	// Nothing waits on prepared requests, their CQEs are dropped once the
+	// memory they pinned is released.
+	for i := 0; i < 100; i++ {
+		_, err := r.prepare(new(int), prepNop)
+		require.NoError(t, err)
+		require.NoError(t, r.submit())
+	}
+	require.NoError(t, r.Nop())
+	eventually(t, func() bool {
+		r.pendMu.Lock()
+		defer r.pendMu.Unlock()
+		return len(r.pins) == 0
+	})
+
+	require.NoError(t, r.Stop())
+	r.pendMu.Lock()
+	require.Empty(t, r.pending)
+	require.Empty(t, r.pins)
+	r.pendMu.Unlock()
+}
+
+func TestRingAsyncCancel(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// A recv on an idle socket only completes once it is canceled.
+	b := make([]byte, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res, _, err := r.completeCtx(ctx, func(sqe *SubmitEntry) {
+		prepRecv(sqe, fds[0], b, 0)
+	})
+	require.NoError(t, err)
+	require.Equal(t, -int32(syscall.ECANCELED), res)
+
+	id, err := r.PrepareRecv(fds[0], b, 0)
+	require.NoError(t, err)
+	require.NoError(t, r.submit())
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, r.AsyncCancel(id, 0))
+	require.Equal(t, syscall.ENOENT, r.AsyncCancel(id, 0))
+}
+
+// eventually fails the test unless cond becomes true within a second.
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
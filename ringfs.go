@@ -0,0 +1,139 @@
+// +build linux,go1.16
+
+package iouring
+
+import (
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	_ fs.FS          = (*RingFS)(nil)
+	_ fs.StatFS      = (*RingFS)(nil)
+	_ fs.ReadFileFS  = (*RingFS)(nil)
+	_ fs.ReadDirFile = (*File)(nil)
+)
+
+// RingFS is an fs.FS for the tree of files under a root directory, files are
+// opened, stated and read with requests on a ring. It can be used anywhere an
+// fs.FS is accepted, such as http.FS, template.ParseFS and fs.WalkDir. Like
+// os.DirFS symbolic links may point outside of the root.
+type RingFS struct {
+	r    *Ring
+	root string
+}
+
+// NewRingFS returns a RingFS for the tree of files under root.
+func NewRingFS(r *Ring, root string) *RingFS {
+	return &RingFS{r: r, root: root}
+}
+
+// join returns the path of the named file.
+func (fsys *RingFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(fsys.root, filepath.FromSlash(name)), nil
+}
+
+// Open implements the fs.FS interface, the file is a *File.
+func (fsys *RingFS) Open(name string) (fs.File, error) {
+	path, err := fsys.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.r.openFile(path, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat implements the fs.StatFS interface using a statx request.
+func (fsys *RingFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := fsys.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	st := &fileStat{name: pathpkg.Base(name)}
+	if err := fsys.r.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BASIC_STATS, &st.sys); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	st.fill()
+	return st, nil
+}
+
+// ReadFile implements the fs.ReadFileFS interface, see Ring.ReadFile.
+func (fsys *RingFS) ReadFile(name string) ([]byte, error) {
+	path, err := fsys.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fsys.r.ReadFile(path)
+	if pathErr, ok := err.(*fs.PathError); ok {
+		pathErr.Path = name
+	}
+	return data, err
+}
+
+// ReadDir implements the fs.ReadDirFile interface, it reads up to n entries
+// of the directory like os.File.ReadDir.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	ents, err := f.readDirents(n)
+	des := make([]fs.DirEntry, 0, len(ents))
+	for _, ent := range ents {
+		de := &dirEntry{
+			r:    f.fio.r,
+			path: filepath.Join(f.dir.path, ent.name),
+			name: ent.name,
+		}
+		typ, ok := direntMode(ent.typ)
+		if !ok {
+			// The file system doesn't store the type in the entries.
+			info, err := de.Info()
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return des, err
+			}
+			typ = info.Mode().Type()
+		}
+		de.typ = typ
+		des = append(des, de)
+	}
+	return des, err
+}
+
+// dirEntry is a fs.DirEntry of a File.
+type dirEntry struct {
+	r    *Ring
+	path string
+	name string
+	typ  fs.FileMode
+}
+
+// Name implements the fs.DirEntry interface.
+func (de *dirEntry) Name() string { return de.name }
+
+// IsDir implements the fs.DirEntry interface.
+func (de *dirEntry) IsDir() bool { return de.typ.IsDir() }
+
+// Type implements the fs.DirEntry interface.
+func (de *dirEntry) Type() fs.FileMode { return de.typ }
+
+// Info implements the fs.DirEntry interface, symbolic links are not
+// followed.
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	st := &fileStat{name: de.name}
+	err := de.r.Statx(unix.AT_FDCWD, de.path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BASIC_STATS, &st.sys)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: de.name, Err: err}
+	}
+	st.fill()
+	return st, nil
+}
@@ -0,0 +1,170 @@
+// +build linux,go1.16
+
+package iouring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"github.com/stretchr/testify/require"
+)
+
+// ringFSTree creates a tree of files for testing a RingFS.
+func ringFSTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ringfs")
+	require.NoError(t, err)
+	files := map[string]string{
+		"hello.txt":          "hello io_uring",
+		"empty":              "",
+		"tmpl/a.tmpl":        `{{define "a"}}A{{template "b"}}{{end}}`,
+		"tmpl/b.tmpl":        `{{define "b"}}B{{end}}`,
+		"static/index.html":  "<html></html>",
+		"static/deep/x/y.go": "package y",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(dir, "link")))
+	return dir
+}
+
+func TestRingFS(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir := ringFSTree(t)
+	defer os.RemoveAll(dir)
+	fsys := NewRingFS(r, dir)
+
+	require.NoError(t, fstest.TestFS(fsys,
+		"hello.txt",
+		"empty",
+		"link",
+		"tmpl/a.tmpl",
+		"static/index.html",
+		"static/deep/x/y.go",
+	))
+
+	data, err := fs.ReadFile(fsys, "hello.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hello io_uring", string(data))
+	fi, err := fs.Stat(fsys, "static")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, "static", fi.Name())
+
+	_, err = fsys.Open("missing")
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, "missing", err.(*fs.PathError).Path)
+	_, err = fsys.ReadFile("static/missing")
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, "static/missing", err.(*fs.PathError).Path)
+	for _, name := range []string{"../etc/passwd", "/hello.txt", "static/"} {
+		_, err = fsys.Open(name)
+		require.Equal(t, fs.ErrInvalid, err.(*fs.PathError).Err, name)
+	}
+
+	var walked []string
+	require.NoError(t, fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		walked = append(walked, path)
+		return nil
+	}))
+	require.True(t, sort.StringsAreSorted(walked))
+	require.Contains(t, walked, "static/deep/x/y.go")
+
+	tmpl, err := template.ParseFS(fsys, "tmpl/*.tmpl")
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, tmpl.ExecuteTemplate(&out, "a", nil))
+	require.Equal(t, "AB", out.String())
+
+	s := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/static/index.html")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "<html></html>", string(body))
+}
+
+func TestFileReadDir(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "readdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// More entries than fit in a single getdents buffer.
+	for i := 0; i < 1000; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file-with-a-long-name-%04d", i))
+		require.NoError(t, ioutil.WriteFile(name, nil, 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	f, err := r.Open(dir)
+	require.NoError(t, err)
+	defer f.Close()
+	var names []string
+	for {
+		des, err := f.ReadDir(7)
+		names = append(names, entryNames(des)...)
+		if err != nil {
+			require.Equal(t, io.EOF, err)
+			break
+		}
+		require.Len(t, des, 7)
+	}
+	want, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, names, len(want))
+
+	des, err := f.ReadDir(-1)
+	require.NoError(t, err)
+	require.Empty(t, des)
+
+	g, err := r.Open(dir)
+	require.NoError(t, err)
+	defer g.Close()
+	des, err = g.ReadDir(0)
+	require.NoError(t, err)
+	require.Len(t, des, len(want))
+	for _, de := range des {
+		info, err := de.Info()
+		require.NoError(t, err)
+		require.Equal(t, de.Name(), info.Name())
+		require.Equal(t, de.Name() == "sub", de.IsDir())
+		require.Equal(t, de.Type(), info.Mode().Type())
+	}
+
+	h, err := r.Open(filepath.Join(dir, "sub"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	_, err = h.ReadDir(1)
+	require.Error(t, err)
+}
+
+// entryNames returns the names of the entries.
+func entryNames(des []fs.DirEntry) []string {
+	names := make([]string, len(des))
+	for i, de := range des {
+		names[i] = de.Name()
+	}
+	return names
+}
@@ -0,0 +1,167 @@
+// +build linux
+
+package iouring
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// shardRingSize is the size of the rings created by ListenSharded.
+	shardRingSize = 1024
+)
+
+// ShardedListener is a net.Listener that merges SO_REUSEPORT listeners which
+// each accept connections on their own Ring. The kernel distributes incoming
+// connections between the listeners.
+type ShardedListener struct {
+	a      net.Addr
+	rings  []*Ring
+	shards []net.Listener
+
+	once    sync.Once
+	stop    chan struct{}
+	accepts chan acceptResult
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+// ListenSharded creates a ring for each of the nRings shards and a
+// SO_REUSEPORT listener on each ring bound to the same address. If the port
+// is zero the port chosen for the first shard is used for all of them. The
+// options are applied to every shard. Connections accepted by a shard use the
+// ring of the shard, so the rings are only stopped by Stop.
+func ListenSharded(network, address string, nRings int, opts ...ListenerOption) (*ShardedListener, error) {
+	if nRings < 1 {
+		return nil, errors.New("nRings must be greater than zero")
+	}
+	s := &ShardedListener{
+		stop:    make(chan struct{}),
+		accepts: make(chan acceptResult),
+	}
+	opts = append(opts, WithSockopts(SOReuseport))
+	for i := 0; i < nRings; i++ {
+		r, err := New(shardRingSize, nil)
+		if err != nil {
+			s.Stop()
+			return nil, err
+		}
+		s.rings = append(s.rings, r)
+		l, err := r.Listen(network, address, opts...)
+		if err != nil {
+			s.Stop()
+			return nil, err
+		}
+		if i == 0 {
+			s.a = l.Addr()
+			address = s.a.String()
+		}
+		s.shards = append(s.shards, l)
+	}
+	return s, nil
+}
+
+// Shards returns the listener of each shard, which can be used to accept
+// connections on a specific ring such as in a thread per core server. Accept
+// on the ShardedListener should not be used together with the shards.
+func (s *ShardedListener) Shards() []net.Listener {
+	return s.shards
+}
+
+// Rings returns the ring of each shard.
+func (s *ShardedListener) Rings() []*Ring {
+	return s.rings
+}
+
+// Accept implements the net.Listener interface, it returns connections from
+// any of the shards.
+func (s *ShardedListener) Accept() (net.Conn, error) {
+	s.once.Do(func() {
+		s.wg.Add(len(s.shards))
+		for _, l := range s.shards {
+			go s.run(l)
+		}
+	})
+	select {
+	case <-s.stop:
+		return nil, &net.OpError{Op: "accept", Net: s.a.Network(), Addr: s.a, Err: errClosed}
+	default:
+	}
+	select {
+	case res := <-s.accepts:
+		return res.c, res.err
+	case <-s.stop:
+		return nil, &net.OpError{Op: "accept", Net: s.a.Network(), Addr: s.a, Err: errClosed}
+	}
+}
+
+// run forwards the connections accepted by a shard.
+func (s *ShardedListener) run(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		c, err := l.Accept()
+		select {
+		case s.accepts <- acceptResult{c: c, err: err}:
+		case <-s.stop:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+	}
+}
+
+// Close implements the net.Listener interface, it closes every shard.
+// Connections that were accepted remain open.
+func (s *ShardedListener) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return &net.OpError{Op: "close", Net: s.a.Network(), Addr: s.a, Err: errClosed}
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	var err error
+	for _, l := range s.shards {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.wg.Wait()
+	return err
+}
+
+// Stop closes the listener if it is open and stops the rings of the shards,
+// connections that were accepted can't be used afterwards.
+func (s *ShardedListener) Stop() error {
+	var err error
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if !closed {
+		err = s.Close()
+	}
+	for _, r := range s.rings {
+		if serr := r.Stop(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Addr implements the net.Listener interface.
+func (s *ShardedListener) Addr() net.Addr {
+	return s.a
+}
@@ -0,0 +1,133 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenSharded(t *testing.T) {
+	const shards = 4
+	s, err := ListenSharded("tcp", "127.0.0.1:0", shards)
+	require.NoError(t, err)
+	defer s.Stop()
+	require.Len(t, s.Shards(), shards)
+	require.Len(t, s.Rings(), shards)
+	for _, l := range s.Shards() {
+		require.Equal(t, s.Addr().String(), l.Addr().String())
+	}
+
+	go func() {
+		for {
+			c, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.Dial("tcp", s.Addr().String())
+			if !assertNoError(t, err) {
+				return
+			}
+			defer c.Close()
+			_, err = c.Write([]byte("ping"))
+			if !assertNoError(t, err) {
+				return
+			}
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c, buf)
+			assertNoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, s.Close())
+	_, err = s.Accept()
+	require.Error(t, err)
+	require.Error(t, s.Close())
+}
+
+// TestListenShardedDistribution checks that the kernel distributes
+// connections between the shards.
+func TestListenShardedDistribution(t *testing.T) {
+	const shards = 4
+	s, err := ListenSharded("tcp", "127.0.0.1:0", shards)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	counts := make([]int, shards)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for i, l := range s.Shards() {
+		wg.Add(1)
+		go func(i int, l net.Listener) {
+			defer wg.Done()
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				counts[i]++
+				mu.Unlock()
+				c.Close()
+			}
+		}(i, l)
+	}
+
+	// Connections from different source ports hash to different sockets.
+	const conns = 200
+	for i := 0; i < conns; i++ {
+		c, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		c.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		mu.Unlock()
+		if total == conns || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, s.Close())
+	wg.Wait()
+
+	total := 0
+	for i, n := range counts {
+		require.True(t, n > 0, "shard %d accepted no connections: %v", i, counts)
+		total += n
+	}
+	require.Equal(t, conns, total)
+}
+
+func assertNoError(t *testing.T, err error) bool {
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+// +build linux
+
+package iouring
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errUnknownSockaddr = errors.New("unknown sockaddr type")
+)
+
+// rawSockaddr converts a syscall.Sockaddr into the raw format used by the
+// kernel and returns it along with the length of the address.
+func rawSockaddr(sa syscall.Sockaddr) (*syscall.RawSockaddrAny, uint32, error) {
+	var rsa syscall.RawSockaddrAny
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		if sa.Port < 0 || sa.Port > 0xFFFF {
+			return nil, 0, syscall.EINVAL
+		}
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&rsa))
+		raw.Family = syscall.AF_INET
+		p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		p[0] = byte(sa.Port >> 8)
+		p[1] = byte(sa.Port)
+		raw.Addr = sa.Addr
+		return &rsa, syscall.SizeofSockaddrInet4, nil
+	case *syscall.SockaddrInet6:
+		if sa.Port < 0 || sa.Port > 0xFFFF {
+			return nil, 0, syscall.EINVAL
+		}
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&rsa))
+		raw.Family = syscall.AF_INET6
+		p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		p[0] = byte(sa.Port >> 8)
+		p[1] = byte(sa.Port)
+		raw.Scope_id = sa.ZoneId
+		raw.Addr = sa.Addr
+		return &rsa, syscall.SizeofSockaddrInet6, nil
+	case *syscall.SockaddrUnix:
+		name := sa.Name
+		n := len(name)
+		raw := (*syscall.RawSockaddrUnix)(unsafe.Pointer(&rsa))
+		if n > len(raw.Path) {
+			return nil, 0, syscall.EINVAL
+		}
+		if n == len(raw.Path) && name[0] != '@' {
+			// There must be room for the trailing NUL.
+			return nil, 0, syscall.EINVAL
+		}
+		raw.Family = syscall.AF_UNIX
+		for i := 0; i < n; i++ {
+			raw.Path[i] = int8(name[i])
+		}
+		// length is family (uint16), name, NUL.
+		sl := uint32(2)
+		if n > 0 {
+			sl += uint32(n) + 1
+		}
+		if raw.Path[0] == '@' {
+			// Abstract sockets start with a NUL and are not NUL
+			// terminated.
+			raw.Path[0] = 0
+			sl--
+		}
+		return &rsa, sl, nil
+	}
+	return nil, 0, errUnknownSockaddr
+}
+
+// anyToSockaddr converts a raw address of length socklen returned by the
+// kernel into a syscall.Sockaddr.
+func anyToSockaddr(rsa *syscall.RawSockaddrAny, socklen uint32) (syscall.Sockaddr, error) {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet4{Addr: raw.Addr}
+		p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		sa.Port = int(p[0])<<8 + int(p[1])
+		return sa, nil
+	case syscall.AF_INET6:
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet6{Addr: raw.Addr, ZoneId: raw.Scope_id}
+		p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		sa.Port = int(p[0])<<8 + int(p[1])
+		return sa, nil
+	case syscall.AF_UNIX:
+		raw := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		n := int(socklen) - 2
+		if n > len(raw.Path) {
+			n = len(raw.Path)
+		}
+		if n <= 0 {
+			// Unnamed socket.
+			return &syscall.SockaddrUnix{}, nil
+		}
+		b := make([]byte, 0, n)
+		if raw.Path[0] == 0 {
+			// Abstract sockets are not NUL terminated, see unix(7).
+			b = append(b, '@')
+			for i := 1; i < n; i++ {
+				b = append(b, byte(raw.Path[i]))
+			}
+			return &syscall.SockaddrUnix{Name: string(b)}, nil
+		}
+		for i := 0; i < n && raw.Path[i] != 0; i++ {
+			b = append(b, byte(raw.Path[i]))
+		}
+		return &syscall.SockaddrUnix{Name: string(b)}, nil
+	}
+	return nil, syscall.EAFNOSUPPORT
+}
+
+// sockaddrToAddr returns a net.Addr for a syscall.Sockaddr.
+func sockaddrToAddr(network string, sa syscall.Sockaddr) *addr {
+	a := &addr{net: network}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		a.s = net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		host := net.IP(sa.Addr[:]).String()
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				host += "%" + ifi.Name
+			}
+		}
+		a.s = net.JoinHostPort(host, strconv.Itoa(sa.Port))
+	case *syscall.SockaddrUnix:
+		a.s = sa.Name
+	}
+	return a
+}
+
+// resolveSockaddr is used to resolve an address for a stream based network
+// and returns the socket family and address.
+func resolveSockaddr(network, address string) (int, syscall.Sockaddr, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		netAddr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return 0, nil, err
+		}
+		return ipSockaddr(network, loopback(network, netAddr.IP), netAddr.Port, netAddr.Zone)
+	case "unix":
+		return syscall.AF_UNIX, &syscall.SockaddrUnix{Name: address}, nil
+	}
+	return 0, nil, net.UnknownNetworkError(network)
+}
+
+// listenSockaddr resolves an address to listen on for a stream based network
+// and returns the socket family, type and address. The "tcp" network listens
+// on both IPv4 and IPv6 when the host is unspecified, dualStack is then true
+// and the address is the IPv6 unspecified address.
+func listenSockaddr(network, address string) (family, sotype int, sa syscall.Sockaddr, dualStack bool, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		netAddr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return 0, 0, nil, false, err
+		}
+		ip := netAddr.IP
+		if network == "tcp" && (len(ip) == 0 || ip.IsUnspecified()) {
+			ip, network, dualStack = net.IPv6unspecified, "tcp6", true
+		}
+		family, sa, err = ipSockaddr(network, ip, netAddr.Port, netAddr.Zone)
+		return family, syscall.SOCK_STREAM, sa, dualStack, err
+	case "unix":
+		return syscall.AF_UNIX, syscall.SOCK_STREAM, &syscall.SockaddrUnix{Name: address}, false, nil
+	case "unixpacket":
+		return syscall.AF_UNIX, syscall.SOCK_SEQPACKET, &syscall.SockaddrUnix{Name: address}, false, nil
+	case "udp", "udp4", "udp6":
+		return 0, 0, nil, false, errors.Errorf("datagram network %s, use ListenPacket", network)
+	}
+	return 0, 0, nil, false, net.UnknownNetworkError(network)
+}
+
+// loopback returns the loopback address for an unspecified IP, which is
+// what the system uses when connecting to an unspecified address.
+func loopback(network string, ip net.IP) net.IP {
+	if len(ip) != 0 && !ip.IsUnspecified() {
+		return ip
+	}
+	if network[len(network)-1] == '6' {
+		return net.IPv6loopback
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// ipSockaddr returns the socket family and address for an IP based network.
+func ipSockaddr(network string, ip net.IP, port int, zone string) (int, syscall.Sockaddr, error) {
+	last := network[len(network)-1]
+	if len(ip) == 0 {
+		if last == '6' {
+			ip = net.IPv6unspecified
+		} else {
+			ip = net.IPv4zero
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil && last != '6' {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return syscall.AF_INET, sa, nil
+	}
+	if last == '4' {
+		return 0, nil, &net.AddrError{Err: "non-IPv4 address", Addr: ip.String()}
+	}
+	sa := &syscall.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	if zone != "" {
+		ifi, err := net.InterfaceByName(zone)
+		if err != nil {
+			return 0, nil, err
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return syscall.AF_INET6, sa, nil
+}
@@ -0,0 +1,408 @@
+// +build linux
+
+package iouring
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// errSpliceDeadline is used internally to signal that a deadline is
+	// set and a buffered copy, which enforces the deadline, must be used.
+	errSpliceDeadline = errors.New("deadline set")
+)
+
+const (
+	// maxSpliceSize is the most that is moved through the pipe at a time,
+	// it is the default capacity of a pipe.
+	maxSpliceSize = 1 << 16
+)
+
+// spliceEnd is one side of a splice copy.
+type spliceEnd struct {
+	fd int
+	// off is the offset to splice at, it is advanced atomically by the
+	// number of bytes spliced. When nil the fd is spliced at its file
+	// offset, if it has one.
+	off *int64
+	// poll is the event that is waited on before splicing, it is used for
+	// non blocking fds.
+	poll int
+	// d is used to cancel the splice when the connection is closed.
+	d *ioDeadline
+}
+
+func (e *spliceEnd) offset() int64 {
+	if e.off == nil {
+		return -1
+	}
+	return atomic.LoadInt64(e.off)
+}
+
+func (e *spliceEnd) advance(n int32) {
+	if e.off != nil && n > 0 {
+		atomic.AddInt64(e.off, int64(n))
+	}
+}
+
+// withSpliceEnd calls fn with the spliceEnd of v, which is read from if
+// read is set or otherwise written to. It returns false if v can't be
+// spliced.
+func withSpliceEnd(v interface{}, read bool, fn func(spliceEnd)) bool {
+	poll := POLLOUT
+	if read {
+		poll = POLLIN
+	}
+	switch v := v.(type) {
+	case *ringConn:
+		d := &v.wd
+		if read {
+			d = &v.rd
+		}
+		fn(spliceEnd{fd: v.fd, poll: poll, d: d})
+		return true
+	case *ringFIO:
+		fn(spliceEnd{fd: int(v.fd), off: v.fOffset})
+		return true
+	case *File:
+		op := "write"
+		if read {
+			op = "read"
+		}
+		if v.incref(op) != nil {
+			return false
+		}
+		defer v.decref()
+		fn(spliceEnd{fd: int(v.fio.fd), off: v.fio.fOffset})
+		return true
+	case syscall.Conn:
+		rc, err := v.SyscallConn()
+		if err != nil {
+			return false
+		}
+		called := false
+		err = rc.Control(func(fd uintptr) {
+			called = true
+			fn(spliceEnd{fd: int(fd), poll: poll})
+		})
+		return err == nil && called
+	}
+	return false
+}
+
+// spliceFrom copies from src to dst with splice. It returns false if the
+// copy must be finished with a buffered copy, the error should then be
+// ignored.
+func (r *Ring) spliceFrom(dst spliceEnd, src io.Reader) (n int64, ok bool, err error) {
+	remain := int64(-1)
+	lr, _ := src.(*io.LimitedReader)
+	if lr != nil {
+		if lr.N <= 0 {
+			return 0, true, nil
+		}
+		remain, src = lr.N, lr.R
+	}
+	spliced := withSpliceEnd(src, true, func(e spliceEnd) {
+		n, ok, err = r.spliceCopy(dst, e, remain)
+	})
+	if lr != nil {
+		lr.N -= n
+	}
+	return n, spliced && ok, err
+}
+
+// spliceTo copies from src to dst with splice. It returns false if the copy
+// must be finished with a buffered copy, the error should then be ignored.
+func (r *Ring) spliceTo(dst io.Writer, src spliceEnd) (n int64, ok bool, err error) {
+	spliced := withSpliceEnd(dst, false, func(e spliceEnd) {
+		n, ok, err = r.spliceCopy(e, src, -1)
+	})
+	return n, spliced && ok, err
+}
+
+// spliceUnsupported returns if the splice error means that a buffered copy
+// should be used instead.
+func spliceUnsupported(errno syscall.Errno) bool {
+	switch errno {
+	case syscall.EINVAL, syscall.ENOSYS, syscall.EOPNOTSUPP, syscall.ESPIPE:
+		return true
+	}
+	return false
+}
+
+// link submits the prepared requests as a single chain and waits for all of
+// them. The requests are canceled if any of the ends is closed. Unless
+// ignoreDeadline is set, errSpliceDeadline is returned when an end has a
+// deadline.
+func (r *Ring) link(ends []*spliceEnd, ignoreDeadline bool, preps ...func(*SubmitEntry)) ([]int32, error) {
+	var locked []*ioDeadline
+	unlock := func() {
+		for _, d := range locked {
+			d.mu.Unlock()
+		}
+	}
+	for _, e := range ends {
+		if e.d == nil {
+			continue
+		}
+		e.d.mu.Lock()
+		locked = append(locked, e.d)
+		if e.d.closed {
+			unlock()
+			return nil, errClosed
+		}
+		if !ignoreDeadline && !e.d.t.IsZero() {
+			unlock()
+			return nil, errSpliceDeadline
+		}
+	}
+
+	sqes, ready := r.submitEntries(len(preps))
+	if sqes == nil {
+		unlock()
+		return nil, errRingUnavailable
+	}
+	ids := make([]uint64, len(preps))
+	reqs := make([]*completionRequest, len(preps))
+	for i, prep := range preps {
+		prep(sqes[i])
+		if i < len(preps)-1 {
+			sqes[i].Flags |= SqeIoLink
+		}
+		ids[i] = r.ID()
+		sqes[i].UserData = ids[i]
+		reqs[i] = r.wait(ids[i])
+	}
+	ready()
+	if err := r.submit(); err != nil {
+		for _, id := range ids {
+			r.fail(id, err)
+		}
+	}
+	for _, d := range locked {
+		if d.inflight == nil {
+			d.inflight = make(map[uint64]struct{})
+		}
+		for _, id := range ids {
+			d.inflight[id] = struct{}{}
+		}
+	}
+	unlock()
+
+	res := make([]int32, len(reqs))
+	for i, req := range reqs {
+		<-req.done
+		res[i], _ = r.release(req)
+	}
+	for _, d := range locked {
+		d.mu.Lock()
+		for _, id := range ids {
+			delete(d.inflight, id)
+		}
+		d.mu.Unlock()
+	}
+	return res, nil
+}
+
+// spliceChain builds the requests for splicing n bytes from src to dst. When
+// src is nil only the data in the pipe is spliced to dst.
+func spliceChain(dst, src *spliceEnd, pipe [2]int, n int) []func(*SubmitEntry) {
+	var preps []func(*SubmitEntry)
+	poll := func(e *spliceEnd, mask int) {
+		preps = append(preps, func(sqe *SubmitEntry) {
+			sqe.Opcode = PollAdd
+			sqe.Fd = int32(e.fd)
+			sqe.UFlags = int32(mask)
+		})
+	}
+	if src != nil {
+		if src.poll != 0 {
+			poll(src, src.poll)
+		}
+		off := src.offset()
+		preps = append(preps, func(sqe *SubmitEntry) {
+			prepSplice(sqe, src.fd, off, pipe[1], -1, n, unix.SPLICE_F_MOVE)
+		})
+	}
+	if dst.poll != 0 {
+		poll(dst, dst.poll)
+	}
+	off := dst.offset()
+	preps = append(preps, func(sqe *SubmitEntry) {
+		prepSplice(sqe, pipe[0], -1, dst.fd, off, n, unix.SPLICE_F_MOVE)
+	})
+	return preps
+}
+
+// spliceResult returns the result of a splice that may be preceded by a poll.
+func spliceResult(res []int32) int32 {
+	if len(res) == 2 && res[0] < 0 {
+		return res[0]
+	}
+	return res[len(res)-1]
+}
+
+// spliceRetry returns if a splice can be tried again.
+func spliceRetry(res int32) bool {
+	switch syscall.Errno(-res) {
+	case syscall.EAGAIN, syscall.ECANCELED, syscall.EINTR:
+		return true
+	}
+	return false
+}
+
+// spliceCopy copies from src to dst through a pipe until EOF, or until
+// remain bytes are copied if remain is not negative. It returns false if
+// the rest of the copy should be done with a buffered copy, which is the
+// case when splice isn't supported for the fds or a deadline is set, the
+// error is then why splice can't be used.
+func (r *Ring) spliceCopy(dst, src spliceEnd, remain int64) (int64, bool, error) {
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC); err != nil {
+		return 0, false, os.NewSyscallError("pipe2", err)
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+	return r.splicePipe(dst, src, pipe, maxSpliceSize, remain)
+}
+
+// splicePipe is like spliceCopy but uses an existing pipe that is empty and
+// splices at most size bytes at a time.
+func (r *Ring) splicePipe(dst, src spliceEnd, pipe [2]int, size int, remain int64) (int64, bool, error) {
+	ends := []*spliceEnd{&src, &dst}
+	var written int64
+	for remain != 0 {
+		n := size
+		if remain > 0 && remain < int64(n) {
+			n = int(remain)
+		}
+		res, err := r.link(ends, false, spliceChain(&dst, &src, pipe, n)...)
+		if err == errSpliceDeadline {
+			return written, false, nil
+		}
+		if err != nil {
+			return written, true, err
+		}
+		k := 1
+		if src.poll != 0 {
+			k = 2
+		}
+		in, out := spliceResult(res[:k]), spliceResult(res[k:])
+		if in < 0 {
+			if spliceRetry(in) {
+				// Closed ends and deadlines are handled by link.
+				continue
+			}
+			errno := syscall.Errno(-in)
+			if written == 0 && spliceUnsupported(errno) {
+				return 0, false, os.NewSyscallError("splice", errno)
+			}
+			return written, true, os.NewSyscallError("splice", errno)
+		}
+		if in == 0 {
+			break
+		}
+		src.advance(in)
+		if remain > 0 {
+			remain -= int64(in)
+		}
+		m, err := r.spliceDrain(&dst, pipe, in, out)
+		written += m
+		if err != nil {
+			return written, true, err
+		}
+	}
+	return written, true, nil
+}
+
+// spliceDrain splices the pending bytes in the pipe to dst, out is the
+// result of the splice to dst that has already completed. The data was
+// already read so deadlines are ignored while draining.
+func (r *Ring) spliceDrain(dst *spliceEnd, pipe [2]int, pending, out int32) (int64, error) {
+	var written int64
+	for {
+		switch {
+		case out > 0:
+			dst.advance(out)
+			written += int64(out)
+			pending -= out
+		case out == 0:
+			return written, io.ErrShortWrite
+		case !spliceRetry(out):
+			return written, os.NewSyscallError("splice", syscall.Errno(-out))
+		}
+		if pending == 0 {
+			return written, nil
+		}
+		res, err := r.link([]*spliceEnd{dst}, true, spliceChain(dst, nil, pipe, int(pending))...)
+		if err != nil {
+			return written, err
+		}
+		out = spliceResult(res)
+	}
+}
+
+// SendFile sends count bytes of the file starting at offset to the socket,
+// like sendfile(2) the file offset is not changed. The file is spliced
+// through a pipe to the socket using linked requests. It returns the number
+// of bytes sent.
+func (r *Ring) SendFile(sockFd, fileFd int, offset int64, count int64) (int64, error) {
+	return r.SendFileContext(context.Background(), sockFd, fileFd, offset, count)
+}
+
+// SendFileContext is like SendFile, if the context is done before the file
+// is sent the requests in flight are canceled and the context error is
+// returned along with the number of bytes sent.
+func (r *Ring) SendFileContext(
+	ctx context.Context,
+	sockFd, fileFd int,
+	offset int64,
+	count int64,
+) (int64, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	// Closing the socket end cancels the requests in flight.
+	canceler := &ioDeadline{}
+	done := make(chan struct{})
+	defer close(done)
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				canceler.close(r)
+			case <-done:
+			}
+		}()
+	}
+
+	n, _, err := r.spliceCopy(
+		spliceEnd{fd: sockFd, poll: POLLOUT, d: canceler},
+		spliceEnd{fd: fileFd, off: &offset},
+		count,
+	)
+	if err == errClosed {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// genericReadFrom is a buffered copy that hides the ReaderFrom of w.
+func genericReadFrom(w io.Writer, r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// genericWriteTo is a buffered copy that hides the WriterTo of r.
+func genericWriteTo(r io.Reader, w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{r})
+}
@@ -0,0 +1,307 @@
+// +build linux
+
+package iouring
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// spliceFile returns a temp file with size random bytes.
+func spliceFile(t *testing.T, size int) (*os.File, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	f, err := ioutil.TempFile("", "splice")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	return f, data
+}
+
+func TestRingConnReadFromFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, data := spliceFile(t, 1<<20+123)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	rw, err := r.fileReadWriter(f)
+	require.NoError(t, err)
+
+	conn, peer := ringConnPair(t, r)
+	defer peer.Close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(peer)
+		got <- b
+	}()
+	n, err := conn.(io.ReaderFrom).ReadFrom(rw)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.NoError(t, conn.Close())
+	require.Equal(t, data, <-got)
+}
+
+func TestRingConnCopyN(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, data := spliceFile(t, 1<<18)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	rw, err := r.fileReadWriter(f)
+	require.NoError(t, err)
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	const size = 100000
+	n, err := io.CopyN(conn, rw, size)
+	require.NoError(t, err)
+	require.Equal(t, int64(size), n)
+	buf := make([]byte, size)
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+	require.Equal(t, data[:size], buf)
+
+	// The file offset is advanced by what was spliced.
+	rest, err := ioutil.ReadAll(rw)
+	require.NoError(t, err)
+	require.Equal(t, data[size:], rest)
+}
+
+func TestRingConnWriteToFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, err := ioutil.TempFile("", "splice")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	rw, err := r.fileReadWriter(f)
+	require.NoError(t, err)
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+
+	data := make([]byte, 1<<20+7)
+	rand.Read(data)
+	go func() {
+		peer.Write(data)
+		peer.Close()
+	}()
+	n, err := io.Copy(rw, conn)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+}
+
+func TestRingConnProxy(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	in, client := ringConnPair(t, r)
+	defer in.Close()
+	out, server := ringConnPair(t, r)
+	defer out.Close()
+
+	data := make([]byte, 1<<19)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(server)
+		got <- b
+	}()
+	n, err := io.Copy(out, in)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.NoError(t, out.Close())
+	require.Equal(t, data, <-got)
+}
+
+func TestRingFIOSplice(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	src, data := spliceFile(t, 1<<17+5)
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "splice")
+	require.NoError(t, err)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	srw, err := r.fileReadWriter(src)
+	require.NoError(t, err)
+	drw, err := r.fileReadWriter(dst)
+	require.NoError(t, err)
+
+	n, err := drw.ReadFrom(srw)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	b, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	// Files are also spliced to an *os.File.
+	out, err := ioutil.TempFile("", "splice")
+	require.NoError(t, err)
+	defer os.Remove(out.Name())
+	defer out.Close()
+	_, err = srw.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	n, err = srw.WriteTo(out)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	b, err = ioutil.ReadFile(out.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+}
+
+func TestRingConnReadFromFallback(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	data := []byte("not spliced")
+	n, err := conn.(io.ReaderFrom).ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
+
+func TestRingConnWriteToDeadline(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = conn.(io.WriterTo).WriteTo(ioutil.Discard)
+	requireTimeout(t, err)
+}
+
+func TestRingConnWriteToClose(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer peer.Close()
+
+	f, err := ioutil.TempFile("", "splice")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.(io.WriterTo).WriteTo(f)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, conn.Close())
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("splice was not interrupted by close")
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, data := spliceFile(t, 1<<20)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	const (
+		offset = 1000
+		count  = 300000
+	)
+	got := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, count)
+		io.ReadFull(peer, buf)
+		got <- buf
+	}()
+	n, err := r.SendFile(conn.(*ringConn).fd, int(f.Fd()), offset, count)
+	require.NoError(t, err)
+	require.Equal(t, int64(count), n)
+	require.Equal(t, data[offset:offset+count], <-got)
+
+	// The file offset is unchanged.
+	pos, err := f.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), pos)
+
+	// Sending past the end of the file is a short transfer.
+	go io.Copy(ioutil.Discard, peer)
+	n, err = r.SendFile(conn.(*ringConn).fd, int(f.Fd()), int64(len(data)-10), 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+}
+
+func TestSendFileContext(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, _ := spliceFile(t, 16<<20)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	conn, peer := ringConnPair(t, r)
+	defer conn.Close()
+	defer peer.Close()
+
+	// The peer never reads so the send blocks once the socket buffers
+	// are full.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	n, err := r.SendFileContext(ctx, conn.(*ringConn).fd, int(f.Fd()), 0, 16<<20)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, n > 0)
+	require.True(t, n < 16<<20)
+}
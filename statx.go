@@ -0,0 +1,74 @@
+// +build linux
+
+package iouring
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// StatMany stats every path relative to dirfd with statx requests that are
+// submitted in batches of up to the size of the SQ, see Statx for the flags
+// and mask. The results and errors are in the same order as the paths, the
+// error of a path is a *os.PathError or nil if the statx succeeded.
+func (r *Ring) StatMany(dirfd int, paths []string, flags, mask int) ([]unix.Statx_t, []error) {
+	stats := make([]unix.Statx_t, len(paths))
+	errs := make([]error, len(paths))
+	window := int(r.p.SqEntries)
+	for start := 0; start < len(paths); start += window {
+		end := start + window
+		if end > len(paths) {
+			end = len(paths)
+		}
+		r.statWindow(dirfd, paths[start:end], flags, mask, stats[start:end], errs[start:end])
+	}
+	return stats, errs
+}
+
+// statWindow submits a statx for each of the paths at once and waits for
+// all of them.
+func (r *Ring) statWindow(dirfd int, paths []string, flags, mask int, stats []unix.Statx_t, errs []error) {
+	ptrs := make([]*byte, len(paths))
+	n := 0
+	for i, path := range paths {
+		p, err := syscall.BytePtrFromString(path)
+		if err != nil {
+			errs[i] = &os.PathError{Op: "statx", Path: path, Err: err}
+			continue
+		}
+		ptrs[i] = p
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	preps := make([]func(*SubmitEntry), 0, n)
+	for i, p := range ptrs {
+		if p == nil {
+			continue
+		}
+		p, st := p, &stats[i]
+		preps = append(preps, func(sqe *SubmitEntry) {
+			prepStatx(sqe, dirfd, p, flags, mask, st)
+		})
+	}
+	res, err := r.batch(preps...)
+	runtime.KeepAlive(ptrs)
+	j := 0
+	for i, p := range ptrs {
+		if p == nil {
+			continue
+		}
+		switch {
+		case err != nil:
+			errs[i] = &os.PathError{Op: "statx", Path: paths[i], Err: err}
+		case res[j] < 0:
+			errs[i] = &os.PathError{Op: "statx", Path: paths[i], Err: syscall.Errno(-res[j])}
+		}
+		j++
+	}
+}
@@ -0,0 +1,111 @@
+// +build linux
+
+package iouring
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// statFiles creates n files of different sizes in a temporary directory and
+// returns the directory and the names of the files.
+func statFiles(t testing.TB, n int) (string, []string) {
+	dir, err := ioutil.TempDir("", "statx")
+	require.NoError(t, err)
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%d", i)
+		err := ioutil.WriteFile(filepath.Join(dir, names[i]), make([]byte, i), 0644)
+		require.NoError(t, err)
+	}
+	return dir, names
+}
+
+func TestStatMany(t *testing.T) {
+	// More paths than SQ entries are stated in windows.
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, names := statFiles(t, 100)
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	require.NoError(t, err)
+	defer d.Close()
+
+	paths := append([]string{}, names...)
+	paths[10] = "missing"
+	paths[20] = "bad\x00path"
+	paths[30] = filepath.Join(dir, names[30])
+	stats, errs := r.StatMany(int(d.Fd()), paths, 0, unix.STATX_BASIC_STATS)
+	require.Len(t, stats, len(paths))
+	require.Len(t, errs, len(paths))
+	for i := range paths {
+		switch i {
+		case 10:
+			require.True(t, os.IsNotExist(errs[i]))
+			require.Equal(t, "missing", errs[i].(*os.PathError).Path)
+		case 20:
+			require.Error(t, errs[i])
+		default:
+			require.NoError(t, errs[i])
+			require.Equal(t, uint64(i), stats[i].Size, paths[i])
+			var want unix.Statx_t
+			require.NoError(t, unix.Statx(int(d.Fd()), paths[i], 0, unix.STATX_BASIC_STATS, &want))
+			require.Equal(t, want.Ino, stats[i].Ino)
+		}
+	}
+
+	stats, errs = r.StatMany(unix.AT_FDCWD, nil, 0, unix.STATX_BASIC_STATS)
+	require.Empty(t, stats)
+	require.Empty(t, errs)
+}
+
+func TestStatxPathTerminated(t *testing.T) {
+	r, err := New(8, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "statx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "a"), 0755))
+
+	// The path is a prefix of a longer string, only the prefix is used.
+	long := filepath.Join(dir, "a") + "/does-not-exist"
+	path := long[:strings.LastIndex(long, "/")]
+	var x unix.Statx_t
+	require.NoError(t, r.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BASIC_STATS, &x))
+	require.Equal(t, uint32(syscall.S_IFDIR), uint32(x.Mode)&syscall.S_IFMT)
+}
+
+func BenchmarkStatMany(b *testing.B) {
+	r, err := New(1024, nil)
+	require.NoError(b, err)
+	defer r.Stop()
+
+	dir, names := statFiles(b, 1000)
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	require.NoError(b, err)
+	defer d.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, errs := r.StatMany(int(d.Fd()), names, 0, unix.STATX_BASIC_STATS)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -3,7 +3,6 @@
 package iouring
 
 import (
-	"runtime"
 	"sync"
 	"sync/atomic"
 
@@ -20,8 +19,6 @@ var (
 	// ErrEntryNotFound is returned when a CQE is not found.
 	ErrEntryNotFound = errors.New("Completion entry not found")
 
-	errCQEMissing = errors.New("cqe missing")
-
 	cqePool = sync.Pool{
 		New: func() interface{} {
 			return &CompletionEntry{}
@@ -100,6 +97,7 @@ func (e *SubmitEntry) Reset() {
 	e.Len = 0
 	e.UFlags = 0
 	e.UserData = 0
+	e.Anon0 = [24]byte{}
 }
 
 // SubmitQueue represents the submit queue ring buffer.
@@ -117,12 +115,6 @@ type SubmitQueue struct {
 	Entries []SubmitEntry
 	// ptr is pointer to the start of the mmap.
 	ptr uintptr
-
-	// entered is when the ring is being entered.
-	entered *uint32
-	// writes is used to keep track of the number of concurrent writers to
-	// the ring.
-	writes *uint32
 }
 
 // Reset is used to reset all entries.
@@ -137,37 +129,6 @@ func (s *SubmitQueue) NeedWakeup() bool {
 	return atomic.LoadUint32(s.Flags)&SqNeedWakeup != 0
 }
 
-func (s *SubmitQueue) enterLock() {
-	for {
-		if atomic.LoadUint32(s.writes) != 0 && atomic.LoadUint32(s.entered) == 1 {
-			runtime.Gosched()
-			continue
-		}
-		if atomic.CompareAndSwapUint32(s.entered, 0, 1) {
-			break
-		}
-	}
-}
-
-func (s *SubmitQueue) enterUnlock() {
-	atomic.StoreUint32(s.entered, 0)
-}
-
-// completeWrite is used to signal that an entry in the map has been fully
-// written.
-func (s *SubmitQueue) completeWrite() {
-	for {
-		writes := atomic.LoadUint32(s.writes)
-		if writes == 0 {
-			panic("invalid number of sq write completions")
-		}
-		if atomic.CompareAndSwapUint32(s.writes, writes, writes-1) {
-			return
-		}
-		runtime.Gosched()
-	}
-}
-
 // CompletionEntry IO completion data structure (Completion Queue Entry).
 type CompletionEntry struct {
 	UserData uint64 /* sqe->data submission data passed back */
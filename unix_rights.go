@@ -0,0 +1,175 @@
+// +build linux
+
+package iouring
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errNoConnFd      = errors.New("connection does not expose a file descriptor")
+	errNoData        = errors.New("at least one byte of data is required")
+	errCtrlTruncated = errors.New("control message truncated, file descriptors were dropped")
+)
+
+// connDo submits the request that prep prepares for the file descriptor of
+// the connection and waits for it. Requests on a ring conn are serialized
+// with its reads or writes and are subject to its deadlines and Close.
+func (r *Ring) connDo(conn net.Conn, write bool, prep func(sqe *SubmitEntry, fd int)) (int32, error) {
+	switch c := conn.(type) {
+	case *ringConn:
+		mu, d := &c.rmu, &c.rd
+		if write {
+			mu, d = &c.wmu, &c.wd
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return d.do(c.r, func(sqe *SubmitEntry) {
+			prep(sqe, c.fd)
+		})
+	case syscall.Conn:
+		rc, err := c.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		var (
+			res  int32
+			ferr error
+		)
+		if err := rc.Control(func(fd uintptr) {
+			res, _, ferr = r.complete(func(sqe *SubmitEntry) {
+				prep(sqe, int(fd))
+			})
+		}); err != nil {
+			return 0, err
+		}
+		return res, ferr
+	}
+	return 0, errNoConnFd
+}
+
+// SendFds sends data along with the file descriptors to a Unix domain socket
+// using a SCM_RIGHTS control message. At least one byte of data must be sent
+// with the file descriptors. It returns the number of bytes of data sent.
+// Like Write, sending on a ring conn is subject to its write deadline.
+func (r *Ring) SendFds(conn net.Conn, data []byte, fds []int) (int, error) {
+	if len(data) == 0 {
+		return 0, errNoData
+	}
+	m := newMsg(data, nil, 0)
+	oob := unix.UnixRights(fds...)
+	m.hdr.Control = &oob[0]
+	m.hdr.SetControllen(len(oob))
+
+	res, err := r.connDo(conn, true, func(sqe *SubmitEntry, fd int) {
+		prepSendmsg(sqe, fd, &m.hdr, 0)
+	})
+	if err == nil && res < 0 {
+		err = syscall.Errno(-res)
+	}
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(oob)
+	runtime.KeepAlive(m)
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "unix", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+	}
+	return int(res), nil
+}
+
+// RecvFds receives data into buf along with up to maxFds file descriptors
+// that were sent using a SCM_RIGHTS control message. The received file
+// descriptors are close on exec. If more than maxFds were sent the received
+// file descriptors are returned along with an error, the rest are closed by
+// the kernel.
+func (r *Ring) RecvFds(conn net.Conn, buf []byte, maxFds int) (int, []int, error) {
+	m := newMsg(buf, nil, 0)
+	oob := make([]byte, unix.CmsgSpace(maxFds*int(unsafe.Sizeof(int32(0)))))
+	if len(oob) > 0 {
+		m.hdr.Control = &oob[0]
+		m.hdr.SetControllen(len(oob))
+	}
+
+	res, err := r.connDo(conn, false, func(sqe *SubmitEntry, fd int) {
+		prepRecvmsg(sqe, fd, &m.hdr, syscall.MSG_CMSG_CLOEXEC)
+	})
+	if err == nil && res < 0 {
+		err = syscall.Errno(-res)
+	}
+	runtime.KeepAlive(buf)
+	runtime.KeepAlive(oob)
+	runtime.KeepAlive(m)
+	if err != nil {
+		return 0, nil, &net.OpError{Op: "read", Net: "unix", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+	}
+	n := int(res)
+
+	fds, err := parseRights(oob[:m.hdr.Controllen])
+	if err != nil {
+		return n, nil, err
+	}
+	if m.hdr.Flags&syscall.MSG_CTRUNC != 0 {
+		return n, fds, errCtrlTruncated
+	}
+	return n, fds, nil
+}
+
+// parseRights returns the file descriptors of any SCM_RIGHTS control
+// messages. If the control messages can't be parsed the file descriptors in
+// them are closed.
+func parseRights(oob []byte) ([]int, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		closeRights(oob)
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		if msgs[i].Header.Level != syscall.SOL_SOCKET ||
+			msgs[i].Header.Type != syscall.SCM_RIGHTS {
+			continue
+		}
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			closeRights(oob)
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// closeRights closes the file descriptors of the SCM_RIGHTS control messages
+// in oob without relying on the control messages being well formed, so that
+// the file descriptors the kernel installed don't leak.
+func closeRights(oob []byte) {
+	hdrLen := unix.CmsgLen(0)
+	for len(oob) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		n := int(h.Len)
+		if n < hdrLen {
+			return
+		}
+		if n > len(oob) {
+			n = len(oob)
+		}
+		if h.Level == syscall.SOL_SOCKET && h.Type == syscall.SCM_RIGHTS {
+			for data := oob[hdrLen:n]; len(data) >= 4; data = data[4:] {
+				syscall.Close(int(*(*int32)(unsafe.Pointer(&data[0]))))
+			}
+		}
+		next := unix.CmsgSpace(n - hdrLen)
+		if next >= len(oob) {
+			return
+		}
+		oob = oob[next:]
+	}
+}
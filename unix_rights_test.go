@@ -0,0 +1,155 @@
+// +build linux
+
+package iouring
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func unixConnPair(t *testing.T, r *Ring) (net.Conn, net.Conn, func()) {
+	sockFile := fmt.Sprintf("%s/rights_test_%d.sock", os.TempDir(), rand.Int())
+	l, err := r.Listen("unix", sockFile)
+	require.NoError(t, err)
+
+	client, err := net.Dial("unix", sockFile)
+	require.NoError(t, err)
+	server, err := l.Accept()
+	require.NoError(t, err)
+	return client, server, func() {
+		client.Close()
+		server.Close()
+		l.Close()
+		os.Remove(sockFile)
+	}
+}
+
+func TestSendRecvFds(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	client, server, cleanup := unixConnPair(t, r)
+	defer cleanup()
+
+	f, err := ioutil.TempFile("", "rights")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	content := []byte("passed over a unix socket")
+	_, err = f.Write(content)
+	require.NoError(t, err)
+
+	data := []byte("fds")
+	n, err := r.SendFds(client, data, []int{int(f.Fd()), int(f.Fd())})
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	buf := make([]byte, 16)
+	n, fds, err := r.RecvFds(server, buf, 2)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+	require.Len(t, fds, 2)
+	for _, fd := range fds {
+		flags, err := unix.FcntlInt(uintptr(fd), syscall.F_GETFD, 0)
+		require.NoError(t, err)
+		require.NotZero(t, flags&syscall.FD_CLOEXEC)
+
+		got := make([]byte, len(content))
+		_, err = syscall.Pread(fd, got, 0)
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.NoError(t, syscall.Close(fd))
+	}
+}
+
+func TestRecvFdsTruncated(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	client, server, cleanup := unixConnPair(t, r)
+	defer cleanup()
+
+	fds := []int{0, 1, 2, 0, 1, 2}
+	_, err = r.SendFds(server, []byte("x"), fds)
+	require.NoError(t, err)
+
+	buf := make([]byte, 1)
+	n, got, err := r.RecvFds(client, buf, 1)
+	require.Equal(t, errCtrlTruncated, err)
+	require.Equal(t, 1, n)
+	for _, fd := range got {
+		syscall.Close(fd)
+	}
+}
+
+func TestSendFdsNoData(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Stop()
+
+	client, _, cleanup := unixConnPair(t, r)
+	defer cleanup()
+
+	_, err = r.SendFds(client, nil, []int{0})
+	require.Error(t, err)
+}
+
+func TestParseRightsMalformed(t *testing.T) {
+	var fds []int
+	for i := 0; i < 3; i++ {
+		fd, err := syscall.Dup(0)
+		require.NoError(t, err)
+		fds = append(fds, fd)
+	}
+	// A well formed SCM_RIGHTS message followed by a header with a bad
+	// length.
+	oob := unix.UnixRights(fds...)
+	bad := make([]byte, unix.CmsgSpace(0))
+	(*unix.Cmsghdr)(unsafe.Pointer(&bad[0])).Len = 1000
+	oob = append(oob, bad...)
+
+	got, err := parseRights(oob)
+	require.Error(t, err)
+	require.Nil(t, got)
+	for _, fd := range fds {
+		_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		require.Equal(t, syscall.EBADF, err)
+	}
+}
+
+func TestRecvFdsDeadline(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	_, server, cleanup := unixConnPair(t, r)
+	defer cleanup()
+
+	// Receiving on a ring conn is subject to its read deadline.
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, err = r.RecvFds(server, make([]byte, 1), 1)
+	require.Error(t, err)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, nerr.Timeout())
+
+	require.NoError(t, server.Close())
+	_, err = r.SendFds(server, []byte("x"), []int{0})
+	require.True(t, errors.Is(err, net.ErrClosed))
+}
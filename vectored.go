@@ -0,0 +1,222 @@
+// +build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// iovMax is the most iovecs that a single readv or writev accepts.
+	iovMax = 1024
+)
+
+// BuffersWriter is implemented by ring connections and files to write many
+// buffers with writev requests instead of copying them together first, like
+// the WriteTo of net.Buffers.
+type BuffersWriter interface {
+	// WriteBuffers writes all of the buffers in order and returns the
+	// number of bytes written.
+	WriteBuffers(bufs [][]byte) (int64, error)
+}
+
+var (
+	_ BuffersWriter = (*ringConn)(nil)
+	_ BuffersWriter = (*File)(nil)
+)
+
+// buildIovecs appends the iovecs for the start of bufs to iovs, empty
+// buffers are skipped and at most iovMax iovecs are used.
+func buildIovecs(iovs []unix.Iovec, bufs [][]byte) []unix.Iovec {
+	for _, b := range bufs {
+		if len(iovs) == iovMax {
+			break
+		}
+		if len(b) == 0 {
+			continue
+		}
+		iov := unix.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
+	}
+	return iovs
+}
+
+// consumeBuffers removes the first n bytes from bufs, the buffers are
+// resliced in place.
+func consumeBuffers(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 {
+		if n < len(bufs[0]) {
+			bufs[0] = bufs[0][n:]
+			return bufs
+		}
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	return bufs
+}
+
+// buffersLen returns the total length of bufs.
+func buffersLen(bufs [][]byte) int64 {
+	var n int64
+	for _, b := range bufs {
+		n += int64(len(b))
+	}
+	return n
+}
+
+// prepVectored returns a function that prepares a readv or writev of the
+// iovecs at the offset.
+func prepVectored(op Opcode, fd int, iovs []unix.Iovec, off int64) func(*SubmitEntry) {
+	return func(sqe *SubmitEntry) {
+		sqe.Opcode = op
+		sqe.Fd = int32(fd)
+		sqe.Addr = (uint64)(uintptr(unsafe.Pointer(&iovs[0])))
+		sqe.Len = uint32(len(iovs))
+		sqe.Offset = uint64(off)
+	}
+}
+
+// ReadvAt reads into bufs at the offset of the file with readv requests. Like
+// io.ReaderAt it keeps reading after a partial read until the buffers are
+// full and returns io.EOF if the end of the file is reached first. It returns
+// the number of bytes read.
+func (r *Ring) ReadvAt(fd int, bufs [][]byte, off int64) (int, error) {
+	return r.vectored(Readv, fd, bufs, off)
+}
+
+// WritevAt writes bufs at the offset of the file with writev requests, the
+// rest of the buffers is written after a partial write. It returns the
+// number of bytes written.
+func (r *Ring) WritevAt(fd int, bufs [][]byte, off int64) (int, error) {
+	return r.vectored(Writev, fd, bufs, off)
+}
+
+// vectored is used for ReadvAt and WritevAt.
+func (r *Ring) vectored(op Opcode, fd int, bufs [][]byte, off int64) (int, error) {
+	name := "readv"
+	if op == Writev {
+		name = "writev"
+	}
+	// Copy the buffers so that the caller's aren't resliced.
+	bufs = append([][]byte(nil), bufs...)
+	mask := POLLIN
+	if op == Writev {
+		mask = POLLOUT
+	}
+	var (
+		iovs []unix.Iovec
+		n    int
+		poll bool
+	)
+	for {
+		iovs = buildIovecs(iovs[:0], bufs)
+		if len(iovs) == 0 {
+			return n, nil
+		}
+		var preps []func(*SubmitEntry)
+		if poll {
+			// The fd is nonblocking, wait until it is ready like
+			// spliceChain does.
+			preps = append(preps, func(sqe *SubmitEntry) {
+				prepPollAdd(sqe, fd, mask)
+			})
+		}
+		preps = append(preps, prepVectored(op, fd, iovs, off+int64(n)))
+		res, err := r.link(nil, true, preps...)
+		runtime.KeepAlive(iovs)
+		if err != nil {
+			return n, err
+		}
+		if poll {
+			if res[0] < 0 {
+				return n, os.NewSyscallError("poll", syscall.Errno(-res[0]))
+			}
+			res = res[1:]
+		}
+		switch {
+		case res[0] == -int32(syscall.EINTR):
+			continue
+		case res[0] == -int32(syscall.EAGAIN):
+			poll = true
+			continue
+		case res[0] < 0:
+			return n, os.NewSyscallError(name, syscall.Errno(-res[0]))
+		case res[0] == 0 && op == Readv:
+			return n, io.EOF
+		case res[0] == 0:
+			return n, io.ErrShortWrite
+		}
+		n += int(res[0])
+		bufs = consumeBuffers(bufs, int(res[0]))
+	}
+}
+
+// WriteBuffers implements the BuffersWriter interface, the file offset is
+// advanced by the number of bytes written.
+func (f *File) WriteBuffers(bufs [][]byte) (int64, error) {
+	if err := f.incref("write"); err != nil {
+		return 0, err
+	}
+	defer f.decref()
+	size := buffersLen(bufs)
+	if size == 0 {
+		return 0, nil
+	}
+	i := &f.fio
+	off := int64(0)
+	if !i.append {
+		off = i.reserve(int(size))
+	}
+	n, err := i.r.WritevAt(int(i.fd), bufs, off)
+	if i.append {
+		if end, serr := unix.Seek(int(i.fd), 0, io.SeekEnd); serr == nil {
+			atomic.StoreInt64(i.fOffset, end)
+		}
+	} else {
+		i.unreserve(off, int(size), n)
+	}
+	if err != nil {
+		return int64(n), i.pathError("write", err)
+	}
+	return int64(n), nil
+}
+
+// WriteBuffers implements the BuffersWriter interface.
+func (c *ringConn) WriteBuffers(bufs [][]byte) (int64, error) {
+	// Like Write the retries after a short write must not interleave with
+	// other writes.
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	bufs = append([][]byte(nil), bufs...)
+	var (
+		iovs []unix.Iovec
+		n    int64
+	)
+	for {
+		iovs = buildIovecs(iovs[:0], bufs)
+		if len(iovs) == 0 {
+			return n, nil
+		}
+		res, err := c.wd.do(c.r, prepVectored(Writev, c.fd, iovs, 0))
+		runtime.KeepAlive(iovs)
+		if err != nil {
+			return n, c.opError("writev", err)
+		}
+		if res < 0 {
+			return n, c.opError("writev", os.NewSyscallError("writev", syscall.Errno(-res)))
+		}
+		if res == 0 {
+			return n, c.opError("writev", io.ErrShortWrite)
+		}
+		n += int64(res)
+		bufs = consumeBuffers(bufs, int(res))
+	}
+}
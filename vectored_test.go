@@ -0,0 +1,170 @@
+// +build linux
+
+package iouring
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// randBuffers returns n random buffers of up to size bytes, some are empty.
+func randBuffers(n, size int) [][]byte {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, rand.Intn(size))
+		rand.Read(bufs[i])
+	}
+	return bufs
+}
+
+func TestReadvWritevAt(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	f, err := ioutil.TempFile("", "vectored")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// More buffers than fit in a single request.
+	bufs := randBuffers(iovMax*2+10, 64)
+	want := bytes.Join(bufs, nil)
+	first := bufs[0]
+	n, err := r.WritevAt(int(f.Fd()), bufs, 100)
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	require.Equal(t, first, bufs[0])
+	got, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, want, got[100:])
+
+	reads := make([][]byte, len(bufs))
+	for i := range reads {
+		reads[i] = make([]byte, len(bufs[i]))
+	}
+	n, err = r.ReadvAt(int(f.Fd()), reads, 100)
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	require.Equal(t, want, bytes.Join(reads, nil))
+
+	// Reading past the end returns io.EOF.
+	n, err = r.ReadvAt(int(f.Fd()), [][]byte{make([]byte, 10), make([]byte, 10)}, int64(len(got))-15)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 15, n)
+
+	n, err = r.ReadvAt(int(f.Fd()), nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestReadvWritevNonblocking(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	var p [2]int
+	require.NoError(t, syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC))
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// The reads wait for the data instead of failing with EAGAIN.
+	want := []byte("hello world")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		syscall.Write(p[1], want[:5])
+		time.Sleep(20 * time.Millisecond)
+		syscall.Write(p[1], want[5:])
+	}()
+	a, b := make([]byte, 3), make([]byte, len(want)-3)
+	n, err := r.ReadvAt(p[0], [][]byte{a, b}, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	require.Equal(t, want, append(a, b...))
+
+	// The writes wait for room in the full pipe.
+	big := make([]byte, 1<<20)
+	done := make(chan []byte, 1)
+	go func() {
+		got := make([]byte, 0, len(big))
+		buf := make([]byte, 64<<10)
+		for len(got) < len(big) {
+			m, err := syscall.Read(p[0], buf)
+			if err == syscall.EAGAIN {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if err != nil {
+				break
+			}
+			got = append(got, buf[:m]...)
+		}
+		done <- got
+	}()
+	n, err = r.WritevAt(p[1], [][]byte{big[:1000], big[1000:]}, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(big), n)
+	require.Equal(t, len(big), len(<-done))
+}
+
+func TestFileWriteBuffers(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	dir, err := ioutil.TempDir("", "vectored")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f, err := r.OpenFile(dir+"/log", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var want []byte
+	for i := 0; i < 3; i++ {
+		bufs := [][]byte{[]byte("record "), {byte('0' + i)}, nil, []byte("\n")}
+		n, err := f.WriteBuffers(bufs)
+		require.NoError(t, err)
+		require.Equal(t, int64(9), n)
+		want = append(want, bytes.Join(bufs, nil)...)
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(want)), off)
+	got, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestRingConnWriteBuffers(t *testing.T) {
+	r, err := New(1024, nil)
+	require.NoError(t, err)
+	defer r.Stop()
+
+	conn, peer := ringConnPair(t, r)
+	defer peer.Close()
+
+	// Large buffers are written partially by the socket.
+	bufs := randBuffers(100, 128<<10)
+	want := bytes.Join(bufs, nil)
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(peer)
+		got <- b
+	}()
+	n, err := conn.(BuffersWriter).WriteBuffers(bufs)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(want)), n)
+	require.NoError(t, conn.Close())
+	require.Equal(t, want, <-got)
+
+	_, err = conn.(BuffersWriter).WriteBuffers(bufs)
+	require.Error(t, err)
+}